@@ -30,6 +30,52 @@ var BatchUpdateInterval = env.Int("BATCH_UPDATE_INTERVAL", 5)
 
 var RelayTimeout = env.Int("RELAY_TIMEOUT", 0) // unit is second
 
+// StreamFirstTokenTimeout is the longest a stream may stay idle before its first chunk, 0 disables it
+var StreamFirstTokenTimeout = env.Int("STREAM_FIRST_TOKEN_TIMEOUT", 30) // unit is second
+
+// requests waiting for a channel which reached its max concurrency
+var ChannelQueueLength = env.Int("CHANNEL_QUEUE_LENGTH", 64)
+var ChannelQueueTimeout = env.Int("CHANNEL_QUEUE_TIMEOUT", 10) // unit is second
+
+// ChannelCooldown is used when a channel returns 429 without telling when to retry
+var ChannelCooldown = env.Int("CHANNEL_COOLDOWN", 10) // unit is second
+
+// ShadowTokenId is the internal token billed for the shadow traffic, shadowing is disabled when it is not set
+var ShadowTokenId = env.Int("SHADOW_TOKEN_ID", 0)
+
+// TrustedProxies is a comma separated list of the proxy IPs or CIDRs whose X-Forwarded-For is honored,
+// empty keeps the default of gin, which trusts every proxy. Set it when the IP allowlists of the tokens matter.
+var TrustedProxies = env.String("TRUSTED_PROXIES", "")
+
+// BudgetTimezone decides where the daily, weekly and monthly token budgets reset, e.g. Asia/Shanghai
+var BudgetTimezone = env.String("BUDGET_TIMEZONE", "Local")
+
+// TokenKeySecret is the HMAC secret of the stored token keys, a random one is kept in the database when it is not set.
+// Changing it invalidates all the keys.
+var TokenKeySecret = env.String("TOKEN_KEY_SECRET", "")
+
+// ChannelMasterKey encrypts the keys and secrets of the channels, CHANNEL_MASTER_KEY_FILE may be used instead.
+// The secrets are kept in plaintext when it is not set. ChannelOldMasterKey is only used to decrypt, during a rotation.
+var ChannelMasterKey = env.String("CHANNEL_MASTER_KEY", "")
+var ChannelOldMasterKey = env.String("CHANNEL_OLD_MASTER_KEY", "")
+
+// TokenKeyRotationGracePeriod is how long the previous key of a rotated token keeps working
+var TokenKeyRotationGracePeriod = env.Int("TOKEN_KEY_ROTATION_GRACE_PERIOD", 24*60*60) // unit is second
+
+// TagsHeader carries the cost attribution tags of a request, like "project=search,env=prod"
+var TagsHeader = env.String("TAGS_HEADER", "X-LLMHub-Tags")
+
+// MaxExportLogs is the most logs written by an export
+var MaxExportLogs = env.Int("MAX_EXPORT_LOGS", 100000)
+
+// PriceSyncFrequency is how often the model lists and prices of the channels are fetched, 0 disables it.
+// The price changes wait for an approval unless PriceSyncAutoApply is set.
+var PriceSyncFrequency = env.Int("PRICE_SYNC_FREQUENCY", 6*60*60) // unit is second
+var PriceSyncAutoApply = env.Bool("PRICE_SYNC_AUTO_APPLY", false)
+
+// PricingTimezone is where the time windows of the price tiers are, e.g. America/Los_Angeles
+var PricingTimezone = env.String("PRICING_TIMEZONE", "Local")
+
 var Theme = env.String("THEME", "default")
 
 var (
@@ -1,24 +1,38 @@
 package ctxkey
 
 const (
-	Config            = "config"
-	Id                = "id"
-	Username          = "username"
-	Role              = "role"
-	Status            = "status"
-	Channel           = "channel"
-	ChannelId         = "channel_id"
-	SpecificChannelId = "specific_channel_id"
-	RequestModel      = "request_model"
-	ConvertedRequest  = "converted_request"
-	OriginalModel     = "original_model"
-	Group             = "group"
-	ModelMapping      = "model_mapping"
-	ChannelName       = "channel_name"
-	TokenId           = "token_id"
-	TokenName         = "token_name"
-	BaseURL           = "base_url"
-	AvailableModels   = "available_models"
-	KeyRequestBody    = "key_request_body"
-	SystemPrompt      = "system_prompt"
+	Config             = "config"
+	Id                 = "id"
+	Username           = "username"
+	Role               = "role"
+	Status             = "status"
+	Channel            = "channel"
+	ChannelId          = "channel_id"
+	SpecificChannelId  = "specific_channel_id"
+	RequestModel       = "request_model"
+	ConvertedRequest   = "converted_request"
+	OriginalModel      = "original_model"
+	Group              = "group"
+	ModelMapping       = "model_mapping"
+	ChannelName        = "channel_name"
+	TokenId            = "token_id"
+	TokenName          = "token_name"
+	BaseURL            = "base_url"
+	AvailableModels    = "available_models"
+	KeyRequestBody     = "key_request_body"
+	SystemPrompt       = "system_prompt"
+	Capabilities       = "capabilities"
+	ModelAlias         = "model_alias"
+	FallbackModels     = "fallback_models"
+	HedgeDelay         = "hedge_delay"
+	MaxConcurrency     = "max_concurrency"
+	CaptureResponse    = "capture_response"
+	ResponseText       = "response_text"
+	TokenRPM           = "token_rpm"
+	TokenTPM           = "token_tpm"
+	TokenUnlimited     = "token_unlimited"
+	KeyGeneration      = "key_generation"
+	TokenParamPolicy   = "token_param_policy"
+	ChannelParamPolicy = "channel_param_policy"
+	Tags               = "tags"
 )
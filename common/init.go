@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -15,13 +16,15 @@ var (
 	PrintVersion = flag.Bool("version", false, "print version and exit")
 	PrintHelp    = flag.Bool("help", false, "print help and exit")
 	LogDir       = flag.String("log-dir", "./logs", "specify the log directory")
+
+	RotateChannelKeys = flag.Bool("rotate-channel-keys", false, "re-encrypt the channel secrets with the current master key and exit")
 )
 
 func printHelp() {
 	fmt.Println("LLMHub " + Version + " - All in one API service for LLM API.")
 	fmt.Println("Copyright (C) 2025 Eloxt. All rights reserved.")
 	fmt.Println("GitHub: https://github.com/eloxt/llmhjub")
-	fmt.Println("Usage: llmhub [--port <port>] [--log-dir <log directory>] [--version] [--help]")
+	fmt.Println("Usage: llmhub [--port <port>] [--log-dir <log directory>] [--rotate-channel-keys] [--version] [--help]")
 }
 
 func Init() {
@@ -44,6 +47,13 @@ func Init() {
 			config.SessionSecret = os.Getenv("SESSION_SECRET")
 		}
 	}
+	if os.Getenv("CHANNEL_MASTER_KEY_FILE") != "" {
+		masterKey, err := os.ReadFile(os.Getenv("CHANNEL_MASTER_KEY_FILE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.ChannelMasterKey = strings.TrimSpace(string(masterKey))
+	}
 	if os.Getenv("SQLITE_PATH") != "" {
 		SQLitePath = os.Getenv("SQLITE_PATH")
 	}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/result"
+	"github.com/eloxt/llmhub/model"
+	"github.com/gin-gonic/gin"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func GetAllAliases(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	keyword := c.Query("keyword")
+	aliases, total, err := model.GetAllAliases(p*config.ItemsPerPage, config.ItemsPerPage, keyword)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnPage(c, p, total, aliases)
+	return
+}
+
+func GetAlias(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	alias, err := model.GetAliasById(id)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, alias)
+	return
+}
+
+func validateAlias(alias *model.Alias) error {
+	alias.Name = strings.TrimSpace(alias.Name)
+	if alias.Name == "" {
+		return fmt.Errorf("别名不能为空")
+	}
+	models := make([]string, 0, len(alias.Models))
+	for _, modelName := range alias.Models {
+		modelName = strings.TrimSpace(modelName)
+		if modelName == "" || slices.Contains(models, modelName) {
+			continue
+		}
+		if modelName == alias.Name {
+			return fmt.Errorf("别名不能指向自身")
+		}
+		models = append(models, modelName)
+	}
+	if len(models) == 0 {
+		return fmt.Errorf("别名至少需要指向一个模型")
+	}
+	alias.Models = models
+	modelNames, err := model.GetModelNameList()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(modelNames, alias.Name) {
+		return fmt.Errorf("别名 %s 与已有模型重名", alias.Name)
+	}
+	return nil
+}
+
+func AddAlias(c *gin.Context) {
+	alias := model.Alias{}
+	err := c.ShouldBindJSON(&alias)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	alias.Id = 0
+	err = validateAlias(&alias)
+	if err != nil {
+		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
+		return
+	}
+	err = alias.Insert()
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, alias)
+	return
+}
+
+func UpdateAlias(c *gin.Context) {
+	alias := model.Alias{}
+	err := c.ShouldBindJSON(&alias)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	err = validateAlias(&alias)
+	if err != nil {
+		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
+		return
+	}
+	err = alias.Update()
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, alias)
+	return
+}
+
+func DeleteAlias(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	err := model.DeleteAliasById(id)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.Return(c)
+	return
+}
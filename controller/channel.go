@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"fmt"
 	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/result"
 	"github.com/eloxt/llmhub/model"
@@ -26,7 +27,7 @@ func GetAllChannels(c *gin.Context) {
 	var channels []*model.Channel
 	var err error
 	var total int64
-	channels, total, err = model.GetAllChannels(p*config.ItemsPerPage, config.ItemsPerPage, "limited", keyword)
+	channels, total, err = model.GetAllChannels(p*config.ItemsPerPage, config.ItemsPerPage, keyword)
 	if err != nil {
 		result.ReturnError(c, err)
 		return
@@ -39,6 +40,8 @@ func GetAllChannels(c *gin.Context) {
 			return
 		}
 		channels[i].Models = models
+		channels[i].InFlight = model.GetChannelInFlight(channels[i].Id)
+		channels[i].RateLimits = model.GetChannelRateLimits(channels[i].Id)
 	}
 	result.ReturnPage(c, p, total, channels)
 	return
@@ -61,10 +64,22 @@ func GetChannel(c *gin.Context) {
 		return
 	}
 	channel.Models = models
+	channel.InFlight = model.GetChannelInFlight(id)
+	channel.RateLimits = model.GetChannelRateLimits(id)
 	result.ReturnData(c, channel)
 	return
 }
 
+func validateChannelModels(channel *model.Channel) error {
+	for _, m := range channel.Models {
+		err := m.Config.ValidateTiers()
+		if err != nil {
+			return fmt.Errorf("模型 %s 的%s", m.Name, err.Error())
+		}
+	}
+	return nil
+}
+
 func AddChannel(c *gin.Context) {
 	channel := model.Channel{}
 	err := c.ShouldBindJSON(&channel)
@@ -72,6 +87,16 @@ func AddChannel(c *gin.Context) {
 		result.ReturnError(c, err)
 		return
 	}
+	err = channel.ParamPolicy.Validate()
+	if err != nil {
+		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
+		return
+	}
+	err = validateChannelModels(&channel)
+	if err != nil {
+		result.ReturnMessage(c, err.Error())
+		return
+	}
 	channel.CreatedTime = time.Now()
 	keys := strings.Split(channel.Key, "\n")
 	channels := make([]model.Channel, 0, len(keys))
@@ -111,11 +136,22 @@ func UpdateChannel(c *gin.Context) {
 		result.ReturnError(c, err)
 		return
 	}
+	err = channel.ParamPolicy.Validate()
+	if err != nil {
+		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
+		return
+	}
+	err = validateChannelModels(&channel)
+	if err != nil {
+		result.ReturnMessage(c, err.Error())
+		return
+	}
 	err = channel.Update()
 	if err != nil {
 		result.ReturnError(c, err)
 		return
 	}
+	channel.RedactSecrets()
 	result.ReturnData(c, channel)
 	return
 }
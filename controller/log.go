@@ -1,13 +1,34 @@
 package controller
 
 import (
+	"encoding/csv"
+	"fmt"
+	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/result"
 	"github.com/eloxt/llmhub/model"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
+func getLogFilter(c *gin.Context) (*model.LogFilter, error) {
+	filter := &model.LogFilter{}
+	filter.Type, _ = strconv.Atoi(c.Query("type"))
+	filter.StartTimestamp, _ = strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	filter.EndTimestamp, _ = strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	filter.Username = c.Query("username")
+	filter.TokenName = c.Query("token_name")
+	filter.ModelName = c.Query("model_name")
+	filter.Channel, _ = strconv.Atoi(c.Query("channel"))
+	// tags=project=search,env=prod
+	var err error
+	filter.Tags, err = model.ParseTags(c.Query("tags"))
+	return filter, err
+}
+
+// GetAllLogs returns the logs, or their statistic by the values of a tag when group_by is given
 func GetAllLogs(c *gin.Context) {
 	p, _ := strconv.Atoi(c.Query("p"))
 	pageSize, _ := strconv.Atoi(c.Query("page_size"))
@@ -17,14 +38,21 @@ func GetAllLogs(c *gin.Context) {
 	if pageSize == 0 {
 		pageSize = 10
 	}
-	logType, _ := strconv.Atoi(c.Query("type"))
-	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
-	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
-	username := c.Query("username")
-	tokenName := c.Query("token_name")
-	modelName := c.Query("model_name")
-	channel, _ := strconv.Atoi(c.Query("channel"))
-	logs, total, err := model.GetAllLogs(logType, startTimestamp, endTimestamp, modelName, username, tokenName, p*pageSize, pageSize, channel)
+	filter, err := getLogFilter(c)
+	if err != nil {
+		result.ReturnMessage(c, err.Error())
+		return
+	}
+	if groupBy := c.Query("group_by"); groupBy != "" {
+		statistics, err := model.GetTagStatistics(filter, groupBy)
+		if err != nil {
+			result.ReturnError(c, err)
+			return
+		}
+		result.ReturnData(c, statistics)
+		return
+	}
+	logs, total, err := model.GetFilteredLogs(filter, p*pageSize, pageSize)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -36,6 +64,67 @@ func GetAllLogs(c *gin.Context) {
 	return
 }
 
+// ExportLogs writes the logs as CSV with a column for each of the tags in group_by,
+// or their statistic by the values of the tag when a single one is given with stat=true
+func ExportLogs(c *gin.Context) {
+	filter, err := getLogFilter(c)
+	if err != nil {
+		result.ReturnMessage(c, err.Error())
+		return
+	}
+	var tagKeys []string
+	if c.Query("group_by") != "" {
+		tagKeys = strings.Split(c.Query("group_by"), ",")
+	}
+	var rows [][]string
+	if c.Query("stat") == "true" && len(tagKeys) == 1 {
+		statistics, err := model.GetTagStatistics(filter, tagKeys[0])
+		if err != nil {
+			result.ReturnError(c, err)
+			return
+		}
+		rows = append(rows, []string{tagKeys[0], "request_count", "quota", "prompt_tokens", "completion_tokens"})
+		for _, statistic := range statistics {
+			rows = append(rows, []string{
+				statistic.TagValue,
+				strconv.Itoa(statistic.RequestCount),
+				strconv.FormatFloat(statistic.Quota, 'f', -1, 64),
+				strconv.Itoa(statistic.PromptTokens),
+				strconv.Itoa(statistic.CompletionTokens),
+			})
+		}
+	} else {
+		logs, _, err := model.GetFilteredLogs(filter, 0, config.MaxExportLogs)
+		if err != nil {
+			result.ReturnError(c, err)
+			return
+		}
+		header := []string{"id", "created_at", "username", "token_name", "model_name", "channel", "quota", "prompt_tokens", "completion_tokens"}
+		rows = append(rows, append(header, tagKeys...))
+		for _, log := range logs {
+			row := []string{
+				strconv.Itoa(log.Id),
+				log.CreatedAt.Format(time.RFC3339),
+				log.Username,
+				log.TokenName,
+				log.ModelName,
+				strconv.Itoa(log.ChannelId),
+				strconv.FormatFloat(log.Quota, 'f', -1, 64),
+				strconv.Itoa(log.PromptTokens),
+				strconv.Itoa(log.CompletionTokens),
+			}
+			for _, key := range tagKeys {
+				row = append(row, log.Tags[key])
+			}
+			rows = append(rows, row)
+		}
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=logs-%s.csv", time.Now().Format("20060102150405")))
+	writer := csv.NewWriter(c.Writer)
+	_ = writer.WriteAll(rows)
+}
+
 func DeleteHistoryLogs(c *gin.Context) {
 	targetTimestamp, _ := strconv.ParseInt(c.Query("target_timestamp"), 10, 64)
 	if targetTimestamp == 0 {
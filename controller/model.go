@@ -3,20 +3,23 @@ package controller
 import (
 	"fmt"
 	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/common/logger"
 	"github.com/eloxt/llmhub/common/result"
 	"github.com/eloxt/llmhub/model"
 	relaymodel "github.com/eloxt/llmhub/relay/model"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"slices"
 	"strings"
 )
 
 // OpenAIModels https://platform.openai.com/docs/api-reference/models/list
 type OpenAIModels struct {
-	Id      string `json:"id"`
-	Object  string `json:"object"`
-	Created int    `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	Id           string   `json:"id"`
+	Object       string   `json:"object"`
+	Created      int      `json:"created"`
+	OwnedBy      string   `json:"owned_by"`
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
 var modelsMap map[string]OpenAIModels
@@ -26,16 +29,54 @@ func init() {
 }
 
 func ListModels(c *gin.Context) {
-	var availableModels []string
+	availableModels, err := model.CacheGetGroupModels(c.Request.Context(), c.GetString(ctxkey.Group))
+	if err != nil {
+		logger.Errorf(c.Request.Context(), "failed to get group models: %s", err.Error())
+	}
+	// the allowlist of the token
+	var patterns []string
 	if c.GetString(ctxkey.AvailableModels) != "" {
-		availableModels = strings.Split(c.GetString(ctxkey.AvailableModels), ",")
-	} else {
-		availableModels, _ = model.CacheGetModelList()
+		patterns = strings.Split(c.GetString(ctxkey.AvailableModels), ",")
+		allowedModels := make([]string, 0, len(availableModels))
+		for _, modelName := range availableModels {
+			if model.MatchModelPatterns(patterns, modelName) {
+				allowedModels = append(allowedModels, modelName)
+			}
+		}
+		availableModels = allowedModels
+	}
+	capabilities, err := model.GetModelCapabilities()
+	if err != nil {
+		logger.Errorf(c.Request.Context(), "failed to get model capabilities: %s", err.Error())
 	}
 	availableOpenAIModels := make([]OpenAIModels, 0)
 	for _, modelName := range availableModels {
 		availableOpenAIModels = append(availableOpenAIModels, OpenAIModels{
-			Id:      modelName,
+			Id:           modelName,
+			Object:       "model",
+			Created:      1626777600,
+			OwnedBy:      "custom",
+			Capabilities: capabilities[modelName],
+		})
+	}
+	aliases, err := model.GetAliasList()
+	if err != nil {
+		logger.Errorf(c.Request.Context(), "failed to get aliases: %s", err.Error())
+	}
+	for _, alias := range aliases {
+		// only the aliases with at least one reachable model
+		reachable := false
+		for _, aliasModel := range alias.Models {
+			if slices.Contains(availableModels, aliasModel) {
+				reachable = true
+				break
+			}
+		}
+		if !reachable || (len(patterns) > 0 && !model.MatchModelPatterns(patterns, alias.Name)) {
+			continue
+		}
+		availableOpenAIModels = append(availableOpenAIModels, OpenAIModels{
+			Id:      alias.Name,
 			Object:  "model",
 			Created: 1626777600,
 			OwnedBy: "custom",
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/common/result"
+	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay/billing"
+	"github.com/gin-gonic/gin"
+	"strconv"
+)
+
+// GetPriceChanges returns the price history, or the changes waiting for an approval with status=pending
+func GetPriceChanges(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	channelId, _ := strconv.Atoi(c.Query("channel_id"))
+	changes, total, err := model.GetPriceChanges(p*config.ItemsPerPage, config.ItemsPerPage, channelId, c.Query("status"))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnPage(c, p, total, changes)
+	return
+}
+
+func ApprovePriceChange(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	change, err := model.ApprovePriceChange(id)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	err = billing.Reload()
+	if err != nil {
+		logger.SysError("failed to reload the billing: " + err.Error())
+	}
+	result.ReturnData(c, change)
+	return
+}
+
+func RejectPriceChange(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	change, err := model.RejectPriceChange(id)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, change)
+	return
+}
+
+// SyncPrices runs the price sync at once, for a single channel when channel_id is given
+func SyncPrices(c *gin.Context) {
+	channelId, _ := strconv.Atoi(c.Query("channel_id"))
+	if channelId == 0 {
+		result.ReturnData(c, billing.SyncAllChannelPrices())
+		return
+	}
+	channel, err := model.GetChannelById(channelId, true)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	syncResult, err := billing.SyncChannelPrices(channel)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	if syncResult.Applied > 0 {
+		err = billing.Reload()
+		if err != nil {
+			logger.SysError("failed to reload the billing: " + err.Error())
+		}
+	}
+	result.ReturnData(c, syncResult)
+	return
+}
@@ -22,6 +22,20 @@ import (
 // https://platform.openai.com/docs/api-reference/chat
 
 func relayHelper(c *gin.Context, relayMode int) *relayModel.ErrorWithStatusCode {
+	channelId := c.GetInt(ctxkey.ChannelId)
+	release, acquireErr := model.AcquireChannel(c.Request.Context(), channelId, c.GetInt(ctxkey.MaxConcurrency))
+	if acquireErr != nil {
+		logger.Warnf(c.Request.Context(), "channel #%d is saturated: %s", channelId, acquireErr.Error())
+		return &relayModel.ErrorWithStatusCode{
+			Error: relayModel.Error{
+				Message: fmt.Sprintf("channel #%d is busy", channelId),
+				Type:    "one_api_error",
+				Code:    "channel_busy",
+			},
+			StatusCode: http.StatusTooManyRequests,
+		}
+	}
+	defer release()
 	var err *relayModel.ErrorWithStatusCode
 	switch relayMode {
 	//case relaymode.ImagesGenerations:
@@ -40,6 +54,16 @@ func relayHelper(c *gin.Context, relayMode int) *relayModel.ErrorWithStatusCode
 	return err
 }
 
+// recordRelayResult counts the result for the channel which answered, the hedged one may have won.
+// The client errors say nothing about the channel, only 5xx, 429 and timeouts are failures.
+func recordRelayResult(c *gin.Context, modelName string, bizErr *relayModel.ErrorWithStatusCode) {
+	if bizErr != nil && bizErr.StatusCode < http.StatusInternalServerError &&
+		bizErr.StatusCode != http.StatusTooManyRequests && bizErr.StatusCode != http.StatusRequestTimeout {
+		return
+	}
+	go model.RecordRelayResult(c.GetInt(ctxkey.ChannelId), modelName, bizErr == nil)
+}
+
 func Relay(c *gin.Context) {
 	ctx := c.Request.Context()
 	relayMode := relaymode.GetByPath(c.Request.URL.Path)
@@ -50,14 +74,16 @@ func Relay(c *gin.Context) {
 	channelId := c.GetInt(ctxkey.ChannelId)
 	userId := c.GetInt(ctxkey.Id)
 	bizErr := relayHelper(c, relayMode)
+	recordRelayResult(c, c.GetString(ctxkey.OriginalModel), bizErr)
 	if bizErr == nil {
 		//monitor.Emit(channelId, true)
 		return
 	}
 	lastFailedChannelId := channelId
 	channelName := c.GetString(ctxkey.ChannelName)
-	//group := c.GetString(ctxkey.Group)
+	group := c.GetString(ctxkey.Group)
 	originalModel := c.GetString(ctxkey.OriginalModel)
+	capabilities := c.GetStringSlice(ctxkey.Capabilities)
 	go processChannelRelayError(ctx, userId, channelId, channelName, *bizErr)
 	requestId := c.GetString(helper.RequestIdKey)
 	retryTimes := config.RetryTimes
@@ -65,27 +91,55 @@ func Relay(c *gin.Context) {
 		logger.Errorf(ctx, "relay error happen, status code is %d, won't retry in this case", bizErr.StatusCode)
 		retryTimes = 0
 	}
-	for i := retryTimes; i > 0; i-- {
-		channel, err := model.CacheGetRandomSatisfiedChannel(originalModel, i != retryTimes)
-		if err != nil {
-			logger.Errorf(ctx, "CacheGetRandomSatisfiedChannel failed: %+v", err)
+	fallbackModels := c.GetStringSlice(ctxkey.FallbackModels)
+	for {
+		for i := retryTimes; i > 0; i-- {
+			channel, err := model.CacheGetRandomSatisfiedChannel(group, originalModel, i != retryTimes, capabilities)
+			if err != nil {
+				logger.Errorf(ctx, "CacheGetRandomSatisfiedChannel failed: %+v", err)
+				break
+			}
+			logger.Infof(ctx, "using channel #%d to retry (remain times %d)", channel.Id, i)
+			if channel.Id == lastFailedChannelId {
+				continue
+			}
+			middleware.SetupContextForSelectedChannel(c, channel, originalModel)
+			requestBody, _ := common.GetRequestBody(c)
+			c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+			bizErr = relayHelper(c, relayMode)
+			recordRelayResult(c, originalModel, bizErr)
+			if bizErr == nil {
+				return
+			}
+			channelId := c.GetInt(ctxkey.ChannelId)
+			lastFailedChannelId = channelId
+			channelName := c.GetString(ctxkey.ChannelName)
+			go processChannelRelayError(ctx, userId, channelId, channelName, *bizErr)
+		}
+		// the model is given up, move on to the next one of the alias chain
+		if len(fallbackModels) == 0 || !shouldRetry(c, bizErr.StatusCode) {
 			break
 		}
-		logger.Infof(ctx, "using channel #%d to retry (remain times %d)", channel.Id, i)
-		if channel.Id == lastFailedChannelId {
+		originalModel, fallbackModels = fallbackModels[0], fallbackModels[1:]
+		if !middleware.IsModelAllowed(c, originalModel) {
 			continue
 		}
+		channel, err := model.CacheGetRandomSatisfiedChannel(group, originalModel, false, capabilities)
+		if err != nil {
+			logger.Errorf(ctx, "CacheGetRandomSatisfiedChannel failed: %+v", err)
+			continue
+		}
+		logger.Infof(ctx, "falling back to model %s using channel #%d", originalModel, channel.Id)
 		middleware.SetupContextForSelectedChannel(c, channel, originalModel)
-		requestBody, err := common.GetRequestBody(c)
+		requestBody, _ := common.GetRequestBody(c)
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
 		bizErr = relayHelper(c, relayMode)
+		recordRelayResult(c, originalModel, bizErr)
 		if bizErr == nil {
 			return
 		}
-		channelId := c.GetInt(ctxkey.ChannelId)
-		lastFailedChannelId = channelId
-		channelName := c.GetString(ctxkey.ChannelName)
-		go processChannelRelayError(ctx, userId, channelId, channelName, *bizErr)
+		lastFailedChannelId = c.GetInt(ctxkey.ChannelId)
+		go processChannelRelayError(ctx, userId, lastFailedChannelId, c.GetString(ctxkey.ChannelName), *bizErr)
 	}
 
 	// deal with error situation
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/result"
+	"github.com/eloxt/llmhub/model"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+)
+
+func GetAllShadows(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	shadows, total, err := model.GetAllShadows(p*config.ItemsPerPage, config.ItemsPerPage)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnPage(c, p, total, shadows)
+	return
+}
+
+func GetShadow(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	shadow, err := model.GetShadowById(id)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, shadow)
+	return
+}
+
+func GetShadowLogs(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	logs, total, err := model.GetShadowLogs(id, p*config.ItemsPerPage, config.ItemsPerPage)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnPage(c, p, total, logs)
+	return
+}
+
+func validateShadow(shadow *model.Shadow) error {
+	shadow.Model = strings.TrimSpace(shadow.Model)
+	shadow.TargetModel = strings.TrimSpace(shadow.TargetModel)
+	if shadow.Model == "" {
+		return fmt.Errorf("模型不能为空")
+	}
+	if shadow.SampleRate < 0 || shadow.SampleRate > 1 {
+		return fmt.Errorf("采样率必须在 0 到 1 之间")
+	}
+	if shadow.RetentionDays < 0 {
+		return fmt.Errorf("保留天数不能为负数")
+	}
+	if shadow.TargetChannelId != 0 {
+		_, err := model.GetChannelById(shadow.TargetChannelId, false)
+		if err != nil {
+			return fmt.Errorf("渠道 #%d 不存在", shadow.TargetChannelId)
+		}
+	} else if shadow.TargetModel == "" {
+		return fmt.Errorf("目标渠道和目标模型不能同时为空")
+	}
+	return nil
+}
+
+func AddShadow(c *gin.Context) {
+	shadow := model.Shadow{}
+	err := c.ShouldBindJSON(&shadow)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	shadow.Id = 0
+	err = validateShadow(&shadow)
+	if err != nil {
+		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
+		return
+	}
+	err = shadow.Insert()
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, shadow)
+	return
+}
+
+func UpdateShadow(c *gin.Context) {
+	shadow := model.Shadow{}
+	err := c.ShouldBindJSON(&shadow)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	err = validateShadow(&shadow)
+	if err != nil {
+		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
+		return
+	}
+	err = shadow.Update()
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, shadow)
+	return
+}
+
+func DeleteShadow(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	err := model.DeleteShadowById(id)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.Return(c)
+	return
+}
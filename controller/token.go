@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/ctxkey"
-	"github.com/eloxt/llmhub/common/random"
 	"github.com/eloxt/llmhub/common/result"
 	"github.com/eloxt/llmhub/model"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -55,10 +57,68 @@ func GetToken(c *gin.Context) {
 	return
 }
 
-func validateToken(token model.Token) error {
+func validateToken(token *model.Token, userId int) error {
 	if len(token.Name) > 30 {
 		return fmt.Errorf("令牌名称过长")
 	}
+	if token.Models != nil {
+		models := strings.Join(token.GetModels(), ",")
+		token.Models = &models
+	}
+	if token.Subnet != nil {
+		prefixes, err := token.GetSubnets()
+		if err != nil {
+			return err
+		}
+		subnets := make([]string, 0, len(prefixes))
+		for _, prefix := range prefixes {
+			subnets = append(subnets, prefix.String())
+		}
+		subnet := strings.Join(subnets, ",")
+		token.Subnet = &subnet
+	}
+	if token.Scopes != nil {
+		for _, scope := range token.GetScopes() {
+			if !slices.Contains(model.TokenScopes, scope) {
+				return fmt.Errorf("无效的权限：%s", scope)
+			}
+		}
+		scopes := strings.Join(token.GetScopes(), ",")
+		token.Scopes = &scopes
+	}
+	err := token.ParamPolicy.Validate()
+	if err != nil {
+		return err
+	}
+	if token.Tags != nil {
+		tags, err := model.ParseTags(*token.Tags)
+		if err != nil {
+			return err
+		}
+		formatted := model.FormatTags(tags)
+		token.Tags = &formatted
+	}
+	if token.RPM < 0 || token.TPM < 0 {
+		return fmt.Errorf("速率限制不能为负数")
+	}
+	if !model.IsValidBudgetPeriod(token.BudgetPeriod) {
+		return fmt.Errorf("无效的预算周期：%s", token.BudgetPeriod)
+	}
+	if token.BudgetAmount < 0 {
+		return fmt.Errorf("预算不能为负数")
+	}
+	if token.BudgetPeriod != "" && token.BudgetAmount == 0 {
+		return fmt.Errorf("设置预算周期时预算必须大于 0")
+	}
+	if token.Group != "" {
+		userGroup, err := model.GetUserGroup(userId)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(model.SplitGroups(userGroup), token.Group) {
+			return fmt.Errorf("分组 %s 不属于当前用户", token.Group)
+		}
+	}
 	return nil
 }
 
@@ -69,7 +129,7 @@ func AddToken(c *gin.Context) {
 		result.ReturnError(c, err)
 		return
 	}
-	err = validateToken(token)
+	err = validateToken(&token, c.GetInt(ctxkey.Id))
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -81,13 +141,24 @@ func AddToken(c *gin.Context) {
 	cleanToken := model.Token{
 		UserId:         c.GetInt(ctxkey.Id),
 		Name:           token.Name,
-		Key:            random.GenerateKey(),
 		CreatedTime:    time.Now(),
 		AccessedTime:   time.Now(),
 		ExpiredTime:    token.ExpiredTime,
 		RemainQuota:    token.RemainQuota,
 		UnlimitedQuota: token.UnlimitedQuota,
+		HedgeDelay:     token.HedgeDelay,
+		Group:          token.Group,
+		Models:         token.Models,
+		Subnet:         token.Subnet,
+		RPM:            token.RPM,
+		TPM:            token.TPM,
+		BudgetPeriod:   token.BudgetPeriod,
+		BudgetAmount:   token.BudgetAmount,
+		Scopes:         token.Scopes,
+		ParamPolicy:    token.ParamPolicy,
+		Tags:           token.Tags,
 	}
+	cleanToken.GenerateKey()
 	err = cleanToken.Insert()
 	if err != nil {
 		result.ReturnError(c, err)
@@ -121,7 +192,7 @@ func UpdateToken(c *gin.Context) {
 		result.ReturnError(c, err)
 		return
 	}
-	err = validateToken(token)
+	err = validateToken(&token, userId)
 	if err != nil {
 		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
 		return
@@ -152,6 +223,17 @@ func UpdateToken(c *gin.Context) {
 	cleanToken.RemainQuota = token.RemainQuota
 	cleanToken.UnlimitedQuota = token.UnlimitedQuota
 	cleanToken.Status = token.Status
+	cleanToken.HedgeDelay = token.HedgeDelay
+	cleanToken.Group = token.Group
+	cleanToken.Models = token.Models
+	cleanToken.Subnet = token.Subnet
+	cleanToken.RPM = token.RPM
+	cleanToken.TPM = token.TPM
+	cleanToken.BudgetPeriod = token.BudgetPeriod
+	cleanToken.BudgetAmount = token.BudgetAmount
+	cleanToken.Scopes = token.Scopes
+	cleanToken.ParamPolicy = token.ParamPolicy
+	cleanToken.Tags = token.Tags
 	err = cleanToken.Update()
 	if err != nil {
 		result.ReturnError(c, err)
@@ -164,3 +246,174 @@ func UpdateToken(c *gin.Context) {
 	})
 	return
 }
+
+func GetTokenBudgets(c *gin.Context) {
+	budgets, err := model.GetUserTokenBudgets(c.GetInt(ctxkey.Id))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, budgets)
+}
+
+// the child key API is authenticated by the parent key, so the teams holding a key can mint their own
+
+func GetChildTokens(c *gin.Context) {
+	tokens, err := model.GetChildTokens(c.GetInt(ctxkey.TokenId))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, tokens)
+}
+
+// validateChildToken makes sure the child can't do more than its parent
+func validateChildToken(parent *model.Token, child *model.Token) error {
+	if len(parent.GetModels()) > 0 {
+		if len(child.GetModels()) == 0 {
+			child.Models = parent.Models
+		}
+		for _, pattern := range child.GetModels() {
+			if !model.MatchModelPatterns(parent.GetModels(), pattern) {
+				return fmt.Errorf("父令牌无权使用模型：%s", pattern)
+			}
+		}
+	}
+	if len(parent.GetScopes()) > 0 && len(child.GetScopes()) == 0 {
+		child.Scopes = parent.Scopes
+	}
+	for _, scope := range child.GetScopes() {
+		if !parent.HasScope(scope) {
+			return fmt.Errorf("父令牌没有 %s 权限", scope)
+		}
+	}
+	parentSubnets, err := parent.GetSubnets()
+	if err != nil {
+		return err
+	}
+	if len(parentSubnets) > 0 {
+		childSubnets, err := child.GetSubnets()
+		if err != nil {
+			return err
+		}
+		if len(childSubnets) == 0 {
+			child.Subnet = parent.Subnet
+		}
+		for _, childSubnet := range childSubnets {
+			if !slices.ContainsFunc(parentSubnets, func(subnet netip.Prefix) bool {
+				return subnet.Bits() <= childSubnet.Bits() && subnet.Contains(childSubnet.Addr())
+			}) {
+				return fmt.Errorf("网段 %s 不在父令牌的允许范围内", childSubnet)
+			}
+		}
+	}
+	if child.Tags == nil {
+		child.Tags = parent.Tags
+	}
+	// the rules of the parent come last, so the child can't undo them
+	child.ParamPolicy = append(child.ParamPolicy, parent.ParamPolicy...)
+	if parent.RPM > 0 && (child.RPM == 0 || child.RPM > parent.RPM) {
+		child.RPM = parent.RPM
+	}
+	if parent.TPM > 0 && (child.TPM == 0 || child.TPM > parent.TPM) {
+		child.TPM = parent.TPM
+	}
+	return nil
+}
+
+func AddChildToken(c *gin.Context) {
+	token := model.Token{}
+	err := c.ShouldBindJSON(&token)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	parent, err := model.GetTokenById(c.GetInt(ctxkey.TokenId))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	// the child always stays in the group of the parent
+	token.Group = c.GetString(ctxkey.Group)
+	err = validateToken(&token, parent.UserId)
+	if err == nil {
+		err = validateChildToken(parent, &token)
+	}
+	if err != nil {
+		result.ReturnMessage(c, fmt.Sprintf("参数错误：%s", err.Error()))
+		return
+	}
+	if token.RemainQuota < 0 {
+		result.ReturnMessage(c, "参数错误：额度不能为负数")
+		return
+	}
+
+	cleanToken := model.Token{
+		Name:           token.Name,
+		CreatedTime:    time.Now(),
+		AccessedTime:   time.Now(),
+		ExpiredTime:    token.ExpiredTime,
+		RemainQuota:    token.RemainQuota,
+		UnlimitedQuota: token.UnlimitedQuota,
+		HedgeDelay:     parent.HedgeDelay,
+		Group:          token.Group,
+		Models:         token.Models,
+		Subnet:         token.Subnet,
+		RPM:            token.RPM,
+		TPM:            token.TPM,
+		BudgetPeriod:   token.BudgetPeriod,
+		BudgetAmount:   token.BudgetAmount,
+		Scopes:         token.Scopes,
+		ParamPolicy:    token.ParamPolicy,
+		Tags:           token.Tags,
+	}
+	cleanToken.GenerateKey()
+	err = model.InsertChildToken(parent, &cleanToken)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, cleanToken)
+}
+
+func RevokeChildToken(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	parent, err := model.GetTokenById(c.GetInt(ctxkey.TokenId))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	err = model.RevokeChildToken(parent, id)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.Return(c)
+}
+
+func RotateTokenKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	gracePeriod := config.TokenKeyRotationGracePeriod
+	if c.Query("grace_period") != "" {
+		gracePeriod, err = strconv.Atoi(c.Query("grace_period"))
+		if err != nil || gracePeriod < 0 {
+			result.ReturnMessage(c, "参数错误：无效的宽限期")
+			return
+		}
+	}
+	token, err := model.GetTokenByIds(id, c.GetInt(ctxkey.Id))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	err = token.RotateKey(time.Duration(gracePeriod) * time.Second)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.ReturnData(c, token)
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"encoding/json"
+	"github.com/eloxt/llmhub/common/ctxkey"
 	"github.com/eloxt/llmhub/common/result"
 	"github.com/eloxt/llmhub/model"
 	"github.com/gin-contrib/sessions"
@@ -86,6 +87,7 @@ func SetupLogin(user *model.User, c *gin.Context) {
 		DisplayName: user.DisplayName,
 		Role:        user.Role,
 		Status:      user.Status,
+		Group:       user.Group,
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"message": "",
@@ -110,3 +112,37 @@ func Logout(c *gin.Context) {
 		"success": true,
 	})
 }
+
+type UpdateUserGroupRequest struct {
+	Id    int    `json:"id"`
+	Group string `json:"group"`
+}
+
+// UpdateUserGroup is only for the admins, a user could otherwise join any group
+func UpdateUserGroup(c *gin.Context) {
+	if !model.IsAdmin(c.GetInt(ctxkey.Id)) {
+		c.JSON(http.StatusForbidden, result.Base{
+			Success: false,
+			Message: "无权进行此操作",
+		})
+		return
+	}
+	var req UpdateUserGroupRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	groups := model.SplitGroups(req.Group)
+	if len(groups) == 0 {
+		result.ReturnMessage(c, "参数错误：分组不能为空")
+		return
+	}
+	err = model.UpdateUserGroup(req.Id, strings.Join(groups, ","))
+	if err != nil {
+		result.ReturnError(c, err)
+		return
+	}
+	result.Return(c)
+	return
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"os"
 	"strconv"
+	"strings"
 )
 
 //go:embed web/build/*
@@ -49,18 +50,52 @@ func main() {
 		}
 	}()
 
+	if *common.RotateChannelKeys {
+		err = model.RotateChannelKeys()
+		if err != nil {
+			logger.FatalLog("failed to rotate channel keys: " + err.Error())
+		}
+		return
+	}
+
 	// Initialize Redis
 	err = common.InitRedisClient()
 	if err != nil {
 		logger.FatalLog("failed to initialize Redis: " + err.Error())
 	}
 
+	if config.MemoryCacheEnabled {
+		logger.SysLog("memory cache enabled")
+		model.InitChannelCache()
+		go model.SyncChannelCache(config.SyncFrequency)
+	}
+	if config.IsMasterNode {
+		go model.SyncRampSchedules()
+		go model.SyncShadowLogRetention()
+		go billing.SyncPrices(config.PriceSyncFrequency)
+	} else {
+		// the prices are changed by the master node
+		go billing.SyncConfigs(config.SyncFrequency)
+	}
+
 	openai.InitTokenEncoders()
 	client.Init()
 	billing.Init()
 
 	// Initialize HTTP server
 	server := gin.New()
+	if config.TrustedProxies != "" {
+		var trustedProxies []string
+		for _, proxy := range strings.Split(config.TrustedProxies, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				trustedProxies = append(trustedProxies, proxy)
+			}
+		}
+		err = server.SetTrustedProxies(trustedProxies)
+		if err != nil {
+			logger.FatalLog("invalid trusted proxies: " + err.Error())
+		}
+	}
 	server.Use(gin.Recovery())
 	server.Use(middleware.RequestId())
 	//server.Use(middleware.Language())
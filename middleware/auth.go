@@ -1,12 +1,17 @@
 package middleware
 
 import (
+	"fmt"
+	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/common/logger"
 	"github.com/eloxt/llmhub/common/result"
 	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay/relaymode"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -43,15 +48,62 @@ func TokenAuth() func(c *gin.Context) {
 			abortWithMessage(c, http.StatusUnauthorized, err.Error())
 			return
 		}
+		if !token.AllowsIP(c.ClientIP()) {
+			logger.Warnf(c.Request.Context(), "token %s (#%d) rejected the client ip %s", token.Name, token.Id, c.ClientIP())
+			abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌不允许从 %s 访问", c.ClientIP()))
+			return
+		}
+		if scope := getRequiredScope(c); scope != "" && !token.HasScope(scope) {
+			abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌没有 %s 权限，无法访问 %s", scope, c.Request.URL.Path))
+			return
+		}
+		userGroup, err := model.CacheGetUserGroup(token.UserId)
+		if err != nil {
+			abortWithMessage(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		userGroups := model.SplitGroups(userGroup)
+		group := token.Group
+		if group == "" && len(userGroups) > 0 {
+			group = userGroups[0]
+		}
+		if !slices.Contains(userGroups, group) {
+			abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("令牌分组 %s 不属于当前用户", group))
+			return
+		}
 		requestModel, err := getRequestModel(c)
 		if err != nil && shouldCheckModel(c) {
 			abortWithMessage(c, http.StatusBadRequest, err.Error())
 			return
 		}
+		if shouldCheckModel(c) && !token.AllowsModel(requestModel) {
+			abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌无权使用模型：%s", requestModel))
+			return
+		}
 		c.Set(ctxkey.RequestModel, requestModel)
+		if len(token.GetModels()) > 0 {
+			c.Set(ctxkey.AvailableModels, strings.Join(token.GetModels(), ","))
+		}
+		var defaultTags map[string]string
+		if token.Tags != nil {
+			defaultTags, _ = model.ParseTags(*token.Tags)
+		}
+		tags, err := model.ParseTags(c.Request.Header.Get(config.TagsHeader))
+		if err != nil {
+			abortWithMessage(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.Set(ctxkey.Tags, model.MergeTags(defaultTags, tags))
 		c.Set(ctxkey.Id, token.UserId)
 		c.Set(ctxkey.TokenId, token.Id)
 		c.Set(ctxkey.TokenName, token.Name)
+		c.Set(ctxkey.KeyGeneration, token.AuthKeyGeneration)
+		c.Set(ctxkey.TokenParamPolicy, token.ParamPolicy)
+		c.Set(ctxkey.Group, group)
+		c.Set(ctxkey.HedgeDelay, token.HedgeDelay)
+		c.Set(ctxkey.TokenRPM, token.RPM)
+		c.Set(ctxkey.TokenTPM, token.TPM)
+		c.Set(ctxkey.TokenUnlimited, token.UnlimitedQuota)
 		if len(parts) > 1 {
 			c.Set(ctxkey.SpecificChannelId, parts[1])
 		}
@@ -65,6 +117,16 @@ func TokenAuth() func(c *gin.Context) {
 	}
 }
 
+func getRequiredScope(c *gin.Context) string {
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/models") && c.Request.Method == http.MethodGet {
+		return model.TokenScopeModelsList
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/api/token/children") {
+		return model.TokenScopeChildTokens
+	}
+	return model.GetScopeByRelayMode(relaymode.GetByPath(c.Request.URL.Path))
+}
+
 func shouldCheckModel(c *gin.Context) bool {
 	if strings.HasPrefix(c.Request.URL.Path, "/v1/completions") {
 		return true
@@ -7,6 +7,7 @@ import (
 	"github.com/eloxt/llmhub/model"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,6 +20,7 @@ func Distribute() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		ctx := c.Request.Context()
 		userId := c.GetInt(ctxkey.Id)
+		group := c.GetString(ctxkey.Group)
 		var requestModel string
 		var channel *model.Channel
 		channelId, ok := c.Get(ctxkey.SpecificChannelId)
@@ -37,12 +39,56 @@ func Distribute() func(c *gin.Context) {
 				abortWithMessage(c, http.StatusForbidden, "该渠道已被禁用")
 				return
 			}
+			// the proxy requests name no model
+			if requestModel := c.GetString(ctxkey.RequestModel); requestModel != "" && !IsModelAllowed(c, requestModel) {
+				abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌无权使用模型：%s", requestModel))
+				return
+			}
 		} else {
 			requestModel = c.GetString(ctxkey.RequestModel)
-			var err error
-			channel, err = model.CacheGetRandomSatisfiedChannel(requestModel, false)
+			capabilities := getRequiredCapabilities(c)
+			c.Set(ctxkey.Capabilities, capabilities)
+			aliasModels, err := model.CacheGetAliasModels(requestModel)
+			if err != nil {
+				logger.Errorf(ctx, "failed to get alias %s: %s", requestModel, err.Error())
+			}
+			if len(aliasModels) > 0 {
+				// the token must be allowed to use the models the alias resolves to, not only the alias
+				allowedModels := make([]string, 0, len(aliasModels))
+				for _, aliasModel := range aliasModels {
+					if IsModelAllowed(c, aliasModel) {
+						allowedModels = append(allowedModels, aliasModel)
+					}
+				}
+				if len(allowedModels) == 0 {
+					abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌无权使用模型：%s", strings.Join(aliasModels, ", ")))
+					return
+				}
+				aliasModels = allowedModels
+				// walk the alias chain until a model with an available channel is found,
+				// the rest of the chain is kept for the retry loop
+				c.Set(ctxkey.ModelAlias, requestModel)
+				for i, aliasModel := range aliasModels {
+					channel, err = model.CacheGetRandomSatisfiedChannel(group, aliasModel, false, capabilities)
+					if err == nil {
+						requestModel = aliasModel
+						c.Set(ctxkey.FallbackModels, aliasModels[i+1:])
+						break
+					}
+				}
+			} else {
+				// TokenAuth only checks the models of some of the paths, the embeddings for one
+				if !IsModelAllowed(c, requestModel) {
+					abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌无权使用模型：%s", requestModel))
+					return
+				}
+				channel, err = model.CacheGetRandomSatisfiedChannel(group, requestModel, false, capabilities)
+			}
 			if err != nil {
-				message := fmt.Sprintf("模型 %s 无可用渠道", requestModel)
+				message := fmt.Sprintf("当前分组 %s 下对于模型 %s 无可用渠道", group, requestModel)
+				if len(capabilities) > 0 {
+					message = fmt.Sprintf("当前分组 %s 下对于模型 %s 无支持 %s 的可用渠道", group, requestModel, strings.Join(capabilities, ", "))
+				}
 				if channel != nil {
 					logger.SysError(fmt.Sprintf("渠道不存在：%d", channel.Id))
 					message = "数据库一致性已被破坏，请联系管理员"
@@ -57,10 +103,18 @@ func Distribute() func(c *gin.Context) {
 	}
 }
 
+// IsModelAllowed checks the model against the allowed models of the token set by TokenAuth
+func IsModelAllowed(c *gin.Context, modelName string) bool {
+	patterns := c.GetString(ctxkey.AvailableModels)
+	return patterns == "" || model.MatchModelPatterns(strings.Split(patterns, ","), modelName)
+}
+
 func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, modelName string) {
 	c.Set(ctxkey.Channel, channel.Type)
 	c.Set(ctxkey.ChannelId, channel.Id)
 	c.Set(ctxkey.ChannelName, channel.Name)
+	c.Set(ctxkey.MaxConcurrency, channel.GetMaxConcurrency())
+	c.Set(ctxkey.ChannelParamPolicy, channel.ParamPolicy)
 	if channel.SystemPrompt != nil && *channel.SystemPrompt != "" {
 		c.Set(ctxkey.SystemPrompt, *channel.SystemPrompt)
 	}
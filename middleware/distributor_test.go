@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/model"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestDistributeChecksAllowedModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	common.RedisEnabled = false
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.DB = db
+	err = db.AutoMigrate(&model.Alias{}, &model.Channel{}, &model.Model{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.POST("/v1/embeddings", func(c *gin.Context) {
+		// what TokenAuth sets for a token limited to some models
+		c.Set(ctxkey.AvailableModels, "text-embedding-3-small,gpt-4o*")
+		c.Set(ctxkey.RequestModel, c.Query("model"))
+	}, Distribute(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{"text-embedding-3-large", http.StatusForbidden},
+		{"text-embedding-ada-002", http.StatusForbidden},
+		// allowed, but there is no channel for it
+		{"text-embedding-3-small", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/v1/embeddings?model="+tt.model, strings.NewReader("{}"))
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, tt.want, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -5,7 +5,13 @@ import (
 	"fmt"
 	"github.com/eloxt/llmhub/common"
 	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/common/helper"
+	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/model"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -108,3 +114,55 @@ func DownloadRateLimit() func(c *gin.Context) {
 func UploadRateLimit() func(c *gin.Context) {
 	return rateLimitFactory(config.UploadRateLimitNum, config.UploadRateLimitDuration, "UP")
 }
+
+func setTokenRateLimitHeaders(c *gin.Context, kind string, rateLimit *model.TokenRateLimit) {
+	c.Header("x-ratelimit-limit-"+kind, strconv.Itoa(rateLimit.Limit))
+	c.Header("x-ratelimit-remaining-"+kind, strconv.Itoa(rateLimit.Remaining))
+	c.Header("x-ratelimit-reset-"+kind, rateLimit.Reset.Round(time.Millisecond).String())
+}
+
+func abortWithTokenRateLimit(c *gin.Context, kind string, rateLimit *model.TokenRateLimit) {
+	retryAfter := max(1, int(math.Ceil(rateLimit.RetryAfter.Seconds())))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	unit := "RPM"
+	if kind == "tokens" {
+		unit = "TPM"
+	}
+	message := fmt.Sprintf("Rate limit reached for %s per min (%s) on token %s: Limit %d. Please try again in %s.",
+		kind, unit, c.GetString(ctxkey.TokenName), rateLimit.Limit, rateLimit.RetryAfter.Round(time.Millisecond))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": gin.H{
+			"message": helper.MessageWithRequestId(message, c.GetString(helper.RequestIdKey)),
+			"type":    kind,
+			"param":   nil,
+			"code":    "rate_limit_exceeded",
+		},
+	})
+	c.Abort()
+	logger.Warn(c.Request.Context(), message)
+}
+
+// TokenRateLimit enforces the requests and tokens per minute of the token, it must run after TokenAuth.
+// The tokens are only checked here, the usage is taken after the response.
+func TokenRateLimit() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		tokenId := c.GetInt(ctxkey.TokenId)
+		requests := model.TakeTokenRequest(tokenId, c.GetInt(ctxkey.TokenRPM))
+		if requests != nil {
+			setTokenRateLimitHeaders(c, "requests", requests)
+			if !requests.Allowed {
+				abortWithTokenRateLimit(c, "requests", requests)
+				return
+			}
+		}
+		tokens := model.CheckTokenTokens(tokenId, c.GetInt(ctxkey.TokenTPM))
+		if tokens != nil {
+			setTokenRateLimitHeaders(c, "tokens", tokens)
+			if !tokens.Allowed {
+				abortWithTokenRateLimit(c, "tokens", tokens)
+				return
+			}
+		}
+		c.Next()
+	}
+}
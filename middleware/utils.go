@@ -5,6 +5,9 @@ import (
 	"github.com/eloxt/llmhub/common"
 	"github.com/eloxt/llmhub/common/helper"
 	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/model"
+	relaymodel "github.com/eloxt/llmhub/relay/model"
+	"github.com/eloxt/llmhub/relay/relaymode"
 	"github.com/gin-gonic/gin"
 	"strings"
 )
@@ -49,6 +52,64 @@ func getRequestModel(c *gin.Context) (string, error) {
 	return modelRequest.Model, nil
 }
 
+// getRequiredCapabilities detects the optional features used by the request,
+// so that it will only be routed to channels supporting them
+func getRequiredCapabilities(c *gin.Context) []string {
+	var capabilities []string
+	switch relaymode.GetByPath(c.Request.URL.Path) {
+	case relaymode.AudioSpeech, relaymode.AudioTranscription, relaymode.AudioTranslation:
+		return []string{model.CapabilityAudio}
+	case relaymode.ChatCompletions, relaymode.Completions:
+	default:
+		return nil
+	}
+	var request relaymodel.GeneralOpenAIRequest
+	err := common.UnmarshalBodyReusable(c, &request)
+	if err != nil {
+		return nil
+	}
+	if len(request.Tools) > 0 || request.Functions != nil {
+		capabilities = append(capabilities, model.CapabilityTools)
+	}
+	if request.ResponseFormat != nil && request.ResponseFormat.Type == "json_schema" {
+		capabilities = append(capabilities, model.CapabilityJSONSchema)
+	}
+	if request.ReasoningEffort != nil {
+		capabilities = append(capabilities, model.CapabilityReasoning)
+	}
+	hasImage, hasAudio := false, request.Audio != nil
+	for _, modality := range request.Modalities {
+		if modality == "audio" {
+			hasAudio = true
+		}
+	}
+	for _, message := range request.Messages {
+		contents, ok := message.Content.([]any)
+		if !ok {
+			continue
+		}
+		for _, content := range contents {
+			contentMap, ok := content.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch contentMap["type"] {
+			case relaymodel.ContentTypeImageURL:
+				hasImage = true
+			case relaymodel.ContentTypeInputAudio:
+				hasAudio = true
+			}
+		}
+	}
+	if hasImage {
+		capabilities = append(capabilities, model.CapabilityVision)
+	}
+	if hasAudio {
+		capabilities = append(capabilities, model.CapabilityAudio)
+	}
+	return capabilities
+}
+
 func isModelInList(modelName string, models string) bool {
 	modelList := strings.Split(models, ",")
 	for _, model := range modelList {
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/logger"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Alias is a virtual model name resolved to an ordered list of real models,
+// the later ones are used as fallbacks when the former ones fail
+type Alias struct {
+	Id          int      `json:"id"`
+	Name        string   `json:"name" gorm:"size:191;uniqueIndex"`
+	Models      []string `json:"models" gorm:"type:text;serializer:json"`
+	Description string   `json:"description" gorm:"type:text"`
+}
+
+func GetAllAliases(startIdx int, num int, keyword string) ([]*Alias, int64, error) {
+	var aliases []*Alias
+	var total int64
+	tx := DB.Model(&Alias{})
+	if keyword != "" {
+		tx = tx.Where("name LIKE ?", keyword+"%")
+	}
+	err := tx.Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&aliases).Error
+	return aliases, total, err
+}
+
+func GetAliasById(id int) (*Alias, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	alias := Alias{Id: id}
+	err := DB.First(&alias, "id = ?", id).Error
+	return &alias, err
+}
+
+func GetAliasList() ([]*Alias, error) {
+	var aliases []*Alias
+	err := DB.Order("name").Find(&aliases).Error
+	return aliases, err
+}
+
+// GetAliasModels returns the models behind the alias, or nil if the name is not an alias
+func GetAliasModels(name string) ([]string, error) {
+	var alias Alias
+	err := DB.Where("name = ?", name).First(&alias).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return alias.Models, nil
+}
+
+func CacheGetAliasModels(name string) ([]string, error) {
+	if !common.RedisEnabled {
+		return GetAliasModels(name)
+	}
+	modelsStr, err := common.RedisGet(fmt.Sprintf("alias:%s", name))
+	if err == nil {
+		if modelsStr == "" {
+			return nil, nil
+		}
+		return strings.Split(modelsStr, ","), nil
+	}
+	models, err := GetAliasModels(name)
+	if err != nil {
+		return nil, err
+	}
+	// names which are not aliases are cached as well, most of the requests are for real models
+	err = common.RedisSet(fmt.Sprintf("alias:%s", name), strings.Join(models, ","), time.Duration(GroupModelsCacheSeconds)*time.Second)
+	if err != nil {
+		logger.SysError("Redis set alias error: " + err.Error())
+	}
+	return models, nil
+}
+
+func cacheDeleteAlias(name string) {
+	if !common.RedisEnabled {
+		return
+	}
+	err := common.RedisDel(fmt.Sprintf("alias:%s", name))
+	if err != nil {
+		logger.SysError("Redis delete alias error: " + err.Error())
+	}
+}
+
+func (alias *Alias) Insert() error {
+	err := DB.Create(alias).Error
+	if err != nil {
+		return err
+	}
+	cacheDeleteAlias(alias.Name)
+	return nil
+}
+
+func (alias *Alias) Update() error {
+	oldAlias, err := GetAliasById(alias.Id)
+	if err != nil {
+		return err
+	}
+	err = DB.Model(alias).Select("name", "models", "description").Updates(alias).Error
+	if err != nil {
+		return err
+	}
+	cacheDeleteAlias(oldAlias.Name)
+	cacheDeleteAlias(alias.Name)
+	return nil
+}
+
+func (alias *Alias) Delete() error {
+	err := DB.Delete(alias).Error
+	if err != nil {
+		return err
+	}
+	cacheDeleteAlias(alias.Name)
+	return nil
+}
+
+func DeleteAliasById(id int) error {
+	alias, err := GetAliasById(id)
+	if err != nil {
+		return err
+	}
+	return alias.Delete()
+}
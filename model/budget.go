@@ -0,0 +1,214 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	BudgetPeriodDaily   = "daily"
+	BudgetPeriodWeekly  = "weekly"
+	BudgetPeriodMonthly = "monthly"
+)
+
+var budgetLocation *time.Location
+var budgetLocationOnce sync.Once
+
+// getBudgetLocation returns the timezone of the period boundaries
+func getBudgetLocation() *time.Location {
+	budgetLocationOnce.Do(func() {
+		location, err := time.LoadLocation(config.BudgetTimezone)
+		if err != nil {
+			logger.SysError("invalid budget timezone, using local time: " + err.Error())
+			location = time.Local
+		}
+		budgetLocation = location
+	})
+	return budgetLocation
+}
+
+func IsValidBudgetPeriod(period string) bool {
+	switch period {
+	case "", BudgetPeriodDaily, BudgetPeriodWeekly, BudgetPeriodMonthly:
+		return true
+	}
+	return false
+}
+
+// getPeriodStart returns the start of the period containing t, weeks start on Monday
+func getPeriodStart(period string, t time.Time) time.Time {
+	t = t.In(getBudgetLocation())
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case BudgetPeriodWeekly:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case BudgetPeriodMonthly:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+func getPeriodEnd(period string, start time.Time) time.Time {
+	switch period {
+	case BudgetPeriodWeekly:
+		return start.AddDate(0, 0, 7)
+	case BudgetPeriodMonthly:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func (t *Token) HasBudget() bool {
+	return t.BudgetPeriod != "" && t.BudgetAmount > 0
+}
+
+// GetPeriodUsedQuota returns the spend of the current period, the stored one belongs to a past period after a boundary
+func (t *Token) GetPeriodUsedQuota(now time.Time) float64 {
+	if !t.HasBudget() || t.PeriodStartTime == nil || t.PeriodStartTime.Before(getPeriodStart(t.BudgetPeriod, now)) {
+		return 0
+	}
+	return t.PeriodUsedQuota
+}
+
+// GetBudgetResetTime returns when the current period ends
+func (t *Token) GetBudgetResetTime(now time.Time) time.Time {
+	return getPeriodEnd(t.BudgetPeriod, getPeriodStart(t.BudgetPeriod, now))
+}
+
+type TokenBudget struct {
+	TokenId         int       `json:"token_id"`
+	TokenName       string    `json:"token_name"`
+	BudgetPeriod    string    `json:"budget_period"`
+	BudgetAmount    float64   `json:"budget_amount"`
+	PeriodUsedQuota float64   `json:"period_used_quota"`
+	RemainBudget    float64   `json:"remain_budget"`
+	PeriodStartTime time.Time `json:"period_start_time"`
+	ResetTime       time.Time `json:"reset_time"`
+}
+
+func (t *Token) GetBudget(now time.Time) *TokenBudget {
+	used := t.GetPeriodUsedQuota(now)
+	return &TokenBudget{
+		TokenId:         t.Id,
+		TokenName:       t.Name,
+		BudgetPeriod:    t.BudgetPeriod,
+		BudgetAmount:    t.BudgetAmount,
+		PeriodUsedQuota: used,
+		RemainBudget:    max(0, t.BudgetAmount-used),
+		PeriodStartTime: getPeriodStart(t.BudgetPeriod, now),
+		ResetTime:       t.GetBudgetResetTime(now),
+	}
+}
+
+func GetUserTokenBudgets(userId int) ([]*TokenBudget, error) {
+	var tokens []*Token
+	err := DB.Where("user_id = ? and budget_period <> ?", userId, "").Order("id desc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	budgets := make([]*TokenBudget, 0, len(tokens))
+	for _, token := range tokens {
+		budgets = append(budgets, token.GetBudget(now))
+	}
+	return budgets, nil
+}
+
+// startTokenPeriod drops the spend of a past period, so the budget resets lazily at the boundaries
+func startTokenPeriod(tx *gorm.DB, token *Token) error {
+	start := getPeriodStart(token.BudgetPeriod, time.Now())
+	return tx.Model(&Token{}).Where("id = ? and (period_start_time is null or period_start_time < ?)", token.Id, start).Updates(
+		map[string]interface{}{
+			"period_used_quota": 0,
+			"period_start_time": start,
+		},
+	).Error
+}
+
+// updateTokenPeriodQuota adds the quota to the spend of the current period
+func updateTokenPeriodQuota(tx *gorm.DB, id int, quota float64) error {
+	var token Token
+	err := tx.Select("id", "budget_period", "budget_amount").First(&token, "id = ?", id).Error
+	if err != nil {
+		return err
+	}
+	if !token.HasBudget() {
+		return nil
+	}
+	err = startTokenPeriod(tx, &token)
+	if err != nil {
+		return err
+	}
+	// a refund of a spend of the previous period must not take the spend of this one below 0
+	return tx.Model(&Token{}).Where("id = ?", id).Update("period_used_quota",
+		gorm.Expr("case when period_used_quota + ? < 0 then 0 else period_used_quota + ? end", quota, quota)).Error
+}
+
+// ErrTokenBudgetExhausted means the budget of the token or of one of its ancestors doesn't cover a reservation
+var ErrTokenBudgetExhausted = errors.New("本期预算已用尽")
+
+// reserveTokenBudget adds the reservation to the spend of the current period when the token has a budget which covers it.
+// The check and the update are a single statement on the live spend, so the requests in flight can't all pass on the same one.
+func reserveTokenBudget(id int, quota float64) (hasBudget bool, ok bool, err error) {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var token Token
+		err := tx.Select("id", "budget_period", "budget_amount").First(&token, "id = ?", id).Error
+		if err != nil {
+			return err
+		}
+		if hasBudget = token.HasBudget(); !hasBudget {
+			return nil
+		}
+		err = startTokenPeriod(tx, &token)
+		if err != nil {
+			return err
+		}
+		result := tx.Model(&Token{}).
+			Where("id = ? and period_used_quota < budget_amount and period_used_quota + ? <= budget_amount", id, quota).
+			Update("period_used_quota", gorm.Expr("period_used_quota + ?", quota))
+		ok = result.RowsAffected == 1
+		return result.Error
+	})
+	return hasBudget, ok, err
+}
+
+// reserveTokenBudgets reserves the quota out of the budgets of the token and of its ancestors,
+// it returns the ids of the ones with a budget, which the reservation has to be released from
+func reserveTokenBudgets(tokenId int, quota float64) ([]int, error) {
+	ancestorIds, err := getTokenAncestorIds(tokenId)
+	if err != nil {
+		return nil, err
+	}
+	reserved := make([]int, 0)
+	for _, id := range append([]int{tokenId}, ancestorIds...) {
+		hasBudget, ok, err := reserveTokenBudget(id, quota)
+		if err == nil && hasBudget && !ok {
+			err = fmt.Errorf("令牌 #%d %w", id, ErrTokenBudgetExhausted)
+		}
+		if err != nil {
+			releaseTokenBudgets(reserved, quota)
+			return nil, err
+		}
+		if hasBudget {
+			reserved = append(reserved, id)
+		}
+	}
+	return reserved, nil
+}
+
+func releaseTokenBudgets(ids []int, quota float64) {
+	for _, id := range ids {
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			return updateTokenPeriodQuota(tx, id, -quota)
+		})
+		if err != nil {
+			logger.SysError(fmt.Sprintf("failed to release the budget of token #%d: %s", id, err.Error()))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func init() {
+	budgetLocationOnce.Do(func() {
+		budgetLocation = time.UTC
+	})
+}
+
+func TestGetPeriodStart(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2026, 10, 14, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		period    string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{BudgetPeriodDaily, time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{BudgetPeriodWeekly, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{BudgetPeriodMonthly, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			start := getPeriodStart(tt.period, now)
+			if !start.Equal(tt.wantStart) {
+				t.Errorf("start = %s, want %s", start, tt.wantStart)
+			}
+			if end := getPeriodEnd(tt.period, start); !end.Equal(tt.wantEnd) {
+				t.Errorf("end = %s, want %s", end, tt.wantEnd)
+			}
+		})
+	}
+	// a Sunday belongs to the week started on the Monday before
+	sunday := time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)
+	if start := getPeriodStart(BudgetPeriodWeekly, sunday); !start.Equal(tests[1].wantStart) {
+		t.Errorf("start of the week of a Sunday = %s, want %s", start, tests[1].wantStart)
+	}
+}
+
+func TestGetPeriodUsedQuota(t *testing.T) {
+	now := time.Date(2026, 10, 14, 15, 30, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1)
+	today := getPeriodStart(BudgetPeriodDaily, now)
+	tests := []struct {
+		name  string
+		token Token
+		want  float64
+	}{
+		{"no budget", Token{PeriodUsedQuota: 5, PeriodStartTime: &today}, 0},
+		{"current period", Token{BudgetPeriod: BudgetPeriodDaily, BudgetAmount: 10, PeriodUsedQuota: 5, PeriodStartTime: &today}, 5},
+		{"past period", Token{BudgetPeriod: BudgetPeriodDaily, BudgetAmount: 10, PeriodUsedQuota: 5, PeriodStartTime: &yesterday}, 0},
+		{"never spent", Token{BudgetPeriod: BudgetPeriodDaily, BudgetAmount: 10}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.token.GetPeriodUsedQuota(now); got != tt.want {
+				t.Errorf("GetPeriodUsedQuota() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserveTokenBudget(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	token := createTestToken(t, &Token{Name: "budget", RemainQuota: 100, BudgetPeriod: BudgetPeriodDaily, BudgetAmount: 10})
+
+	for i := 0; i < 2; i++ {
+		ok, err := ReserveTokenQuota(ctx, token.Id, 5, false)
+		if err != nil || !ok {
+			t.Fatalf("reservation %d within the budget failed: %v", i+1, err)
+		}
+	}
+	// the reservations in flight count against the budget
+	_, err := ReserveTokenQuota(ctx, token.Id, 1, false)
+	if !errors.Is(err, ErrTokenBudgetExhausted) {
+		t.Fatalf("err = %v, want ErrTokenBudgetExhausted", err)
+	}
+	if remain := getTestToken(t, token.Id).RemainQuota; remain != 90 {
+		t.Errorf("remain quota = %v after a rejected reservation, want 90", remain)
+	}
+
+	err = ReleaseTokenQuota(token.Id, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SettleTokenQuota(token.Id, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := getTestToken(t, token.Id)
+	if used := stored.GetPeriodUsedQuota(time.Now()); used != 2 {
+		t.Errorf("period spend = %v after settling 2, want 2", used)
+	}
+	if stored.RemainQuota != 98 || stored.UsedQuota != 2 {
+		t.Errorf("remain/used = %v/%v, want 98/2", stored.RemainQuota, stored.UsedQuota)
+	}
+
+	// a spend of a past period is dropped on the next reservation
+	yesterday := time.Now().AddDate(0, 0, -1)
+	err = DB.Model(&Token{}).Where("id = ?", token.Id).Updates(map[string]any{"period_used_quota": 10, "period_start_time": yesterday}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := ReserveTokenQuota(ctx, token.Id, 8, false)
+	if err != nil || !ok {
+		t.Fatalf("reservation after the period reset failed: %v", err)
+	}
+}
+
+func TestReserveTokenBudgetOfAncestors(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	parent := createTestToken(t, &Token{Name: "parent", UnlimitedQuota: true, BudgetPeriod: BudgetPeriodDaily, BudgetAmount: 10})
+	child := createTestToken(t, &Token{Name: "child", ParentId: parent.Id, UnlimitedQuota: true})
+
+	ok, err := ReserveTokenQuota(ctx, child.Id, 6, true)
+	if err != nil || !ok {
+		t.Fatalf("reservation within the budget of the parent failed: %v", err)
+	}
+	_, err = ReserveTokenQuota(ctx, child.Id, 6, true)
+	if !errors.Is(err, ErrTokenBudgetExhausted) {
+		t.Fatalf("err = %v, want ErrTokenBudgetExhausted", err)
+	}
+	// the parent itself is limited by the spend of its child as well
+	_, err = ReserveTokenQuota(ctx, parent.Id, 6, true)
+	if !errors.Is(err, ErrTokenBudgetExhausted) {
+		t.Fatalf("err = %v, want ErrTokenBudgetExhausted", err)
+	}
+	err = ReleaseTokenQuota(child.Id, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := getTestToken(t, parent.Id).GetPeriodUsedQuota(time.Now()); used != 0 {
+		t.Errorf("period spend of the parent = %v after the release, want 0", used)
+	}
+}
@@ -8,8 +8,8 @@ import (
 	"github.com/eloxt/llmhub/common"
 	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/logger"
-	"github.com/eloxt/llmhub/common/random"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,23 +24,40 @@ var (
 	GroupModelsCacheSeconds   = config.SyncFrequency
 )
 
+// cachedToken keeps the key hashes and the ancestors, which are never part of the JSON of a token
+type cachedToken struct {
+	Token
+	Key         string   `json:"key_hash"`
+	PreviousKey *string  `json:"previous_key_hash"`
+	Ancestors   []*Token `json:"ancestors,omitempty"`
+}
+
+// CacheGetTokenByKey finds the token by its current key or by the previous one during the grace period of a rotation
 func CacheGetTokenByKey(key string) (*Token, error) {
+	key = HashTokenKey(key)
 	keyCol := "`key`"
 	if common.UsingPostgreSQL {
 		keyCol = `"key"`
 	}
 	var token Token
 	if !common.RedisEnabled {
-		err := DB.Where(keyCol+" = ?", key).First(&token).Error
+		err := DB.Where(keyCol+" = ? or previous_key = ?", key, key).First(&token).Error
 		return &token, err
 	}
 	tokenObjectString, err := common.RedisGet(fmt.Sprintf("token:%s", key))
 	if err != nil {
-		err := DB.Where(keyCol+" = ?", key).First(&token).Error
+		err := DB.Where(keyCol+" = ? or previous_key = ?", key, key).First(&token).Error
 		if err != nil {
 			return nil, err
 		}
-		jsonBytes, err := json.Marshal(token)
+		if token.ParentId != 0 {
+			// the ancestors are cached with the token, so a child key doesn't walk the chain on every request
+			token.Ancestors, err = getTokenAncestors(&token)
+			if err != nil {
+				logger.SysError("failed to get token ancestors: " + err.Error())
+			}
+		}
+		jsonBytes, err := json.Marshal(cachedToken{Token: token, Key: token.Key, PreviousKey: token.PreviousKey, Ancestors: token.Ancestors})
 		if err != nil {
 			return nil, err
 		}
@@ -50,7 +67,12 @@ func CacheGetTokenByKey(key string) (*Token, error) {
 		}
 		return &token, nil
 	}
-	err = json.Unmarshal([]byte(tokenObjectString), &token)
+	var cached cachedToken
+	err = json.Unmarshal([]byte(tokenObjectString), &cached)
+	token = cached.Token
+	token.Key = cached.Key
+	token.PreviousKey = cached.PreviousKey
+	token.Ancestors = cached.Ancestors
 	return &token, err
 }
 
@@ -77,7 +99,7 @@ func fetchAndUpdateUserQuota(ctx context.Context, id int) (quota float64, err er
 	if err != nil {
 		return 0, err
 	}
-	err = common.RedisSet(fmt.Sprintf("user_quota:%d", id), fmt.Sprintf("%d", quota), time.Duration(UserId2QuotaCacheSeconds)*time.Second)
+	err = common.RedisSet(fmt.Sprintf("user_quota:%d", id), fmt.Sprintf("%f", quota), time.Duration(UserId2QuotaCacheSeconds)*time.Second)
 	if err != nil {
 		logger.Error(ctx, "Redis set user quota error: "+err.Error())
 	}
@@ -97,7 +119,7 @@ func CacheGetUserQuota(ctx context.Context, id int) (quota float64, err error) {
 		return 0, nil
 	}
 	if quota <= config.PreConsumedQuota { // when user's quota is less than pre-consumed quota, we need to fetch from db
-		logger.Infof(ctx, "user %d's cached quota is too low: %d, refreshing from db", quota, id)
+		logger.Infof(ctx, "user %d's cached quota is too low: %f, refreshing from db", id, quota)
 		return fetchAndUpdateUserQuota(ctx, id)
 	}
 	return quota, nil
@@ -111,7 +133,7 @@ func CacheUpdateUserQuota(ctx context.Context, id int) error {
 	if err != nil {
 		return err
 	}
-	err = common.RedisSet(fmt.Sprintf("user_quota:%d", id), fmt.Sprintf("%d", quota), time.Duration(UserId2QuotaCacheSeconds)*time.Second)
+	err = common.RedisSet(fmt.Sprintf("user_quota:%d", id), fmt.Sprintf("%f", quota), time.Duration(UserId2QuotaCacheSeconds)*time.Second)
 	return err
 }
 
@@ -153,6 +175,9 @@ func CacheGetGroupModels(ctx context.Context, group string) ([]string, error) {
 	}
 	modelsStr, err := common.RedisGet(fmt.Sprintf("group_models:%s", group))
 	if err == nil {
+		if modelsStr == "" {
+			return nil, nil
+		}
 		return strings.Split(modelsStr, ","), nil
 	}
 	models, err := GetGroupModels(ctx, group)
@@ -166,7 +191,16 @@ func CacheGetGroupModels(ctx context.Context, group string) ([]string, error) {
 	return models, nil
 }
 
-var model2channels map[string][]*Channel
+// channelCandidate is a channel able to serve a model, together with the model row that links them.
+// The priority is the one of the model row, in the memory cache as in the database.
+type channelCandidate struct {
+	channel  *Channel
+	model    *Model
+	priority int64
+}
+
+// group2model2channels maps each user group to the channels it can use for each model
+var group2model2channels map[string]map[string][]*channelCandidate
 var channelSyncLock sync.RWMutex
 
 func InitChannelCache() {
@@ -180,16 +214,34 @@ func InitChannelCache() {
 		id2Channel[channel.Id] = channel
 	}
 
-	newModel2channels := make(map[string][]*Channel)
+	newGroup2model2channels := make(map[string]map[string][]*channelCandidate)
 	for _, model := range models {
-		if _, ok := newModel2channels[model.MappedName]; !ok {
-			newModel2channels[model.MappedName] = make([]*Channel, 0)
+		channel, ok := id2Channel[model.ChannelId]
+		if !ok || !model.Enabled {
+			continue
+		}
+		for _, group := range channel.GetGroups() {
+			if _, ok := newGroup2model2channels[group]; !ok {
+				newGroup2model2channels[group] = make(map[string][]*channelCandidate)
+			}
+			newGroup2model2channels[group][model.MappedName] = append(newGroup2model2channels[group][model.MappedName], &channelCandidate{
+				channel:  channel,
+				model:    model,
+				priority: model.GetPriority(),
+			})
+		}
+	}
+	// sort by priority
+	for _, model2channels := range newGroup2model2channels {
+		for _, candidates := range model2channels {
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return candidates[i].priority > candidates[j].priority
+			})
 		}
-		newModel2channels[model.MappedName] = append(newModel2channels[model.MappedName], id2Channel[model.ChannelId])
 	}
 
 	channelSyncLock.Lock()
-	model2channels = newModel2channels
+	group2model2channels = newGroup2model2channels
 	channelSyncLock.Unlock()
 	logger.SysLog("channels synced from database")
 }
@@ -202,34 +254,77 @@ func SyncChannelCache(frequency int) {
 	}
 }
 
-func CacheGetRandomSatisfiedChannel(model string, ignoreFirstPriority bool) (*Channel, error) {
-	if !config.MemoryCacheEnabled {
-		return GetRandomSatisfiedChannel(model, ignoreFirstPriority)
+// filterCandidates drops the candidates that cannot serve the request, keeping the priority order
+func filterCandidates(candidates []*channelCandidate, model string, capabilities []string) []*channelCandidate {
+	filtered := make([]*channelCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !candidate.model.Config.Supports(capabilities) {
+			continue
+		}
+		filtered = append(filtered, candidate)
 	}
-	channelSyncLock.RLock()
-	defer channelSyncLock.RUnlock()
-	channels := model2channels[model]
-	if len(channels) == 0 {
-		return nil, errors.New("channel not found")
+	filtered = filterRateLimited(filtered, model)
+	// prefer the channels with free slots, the saturated ones are only used when all of them are
+	available := filterSaturated(filtered)
+	if len(available) != 0 {
+		return available
 	}
-	endIdx := len(channels)
+	return filtered
+}
+
+// pickWeighted randomly chooses a candidate according to the weights of the model rows,
+// a row with a zero weight is only used when all of them are zero
+func pickWeighted(candidates []*channelCandidate) *channelCandidate {
+	total := 0
+	for _, candidate := range candidates {
+		total += max(candidate.model.GetWeight(), 0)
+	}
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	r := rand.Intn(total)
+	for _, candidate := range candidates {
+		r -= max(candidate.model.GetWeight(), 0)
+		if r < 0 {
+			return candidate
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickCandidate randomly chooses among the highest priority candidates, or among the lower ones on retry.
+// The candidates must be sorted by priority in descending order.
+func pickCandidate(candidates []*channelCandidate, ignoreFirstPriority bool) *channelCandidate {
+	endIdx := len(candidates)
 	// choose by priority
-	firstChannel := channels[0]
-	if firstChannel.GetPriority() > 0 {
-		for i := range channels {
-			if channels[i].GetPriority() != firstChannel.GetPriority() {
+	firstCandidate := candidates[0]
+	if firstCandidate.priority > 0 {
+		for i := range candidates {
+			if candidates[i].priority != firstCandidate.priority {
 				endIdx = i
 				break
 			}
 		}
 	}
-	idx := rand.Intn(endIdx)
-	if ignoreFirstPriority {
-		if endIdx < len(channels) { // which means there are more than one priority
-			idx = random.RandRange(endIdx, len(channels))
-		}
+	if ignoreFirstPriority && endIdx < len(candidates) { // which means there are more than one priority
+		return pickWeighted(candidates[endIdx:])
+	}
+	return pickWeighted(candidates[:endIdx])
+}
+
+func CacheGetRandomSatisfiedChannel(group string, model string, ignoreFirstPriority bool, capabilities []string) (*Channel, error) {
+	if !config.MemoryCacheEnabled {
+		return GetRandomSatisfiedChannel(group, model, ignoreFirstPriority, capabilities)
+	}
+	channelSyncLock.RLock()
+	candidates := group2model2channels[group][model]
+	channelSyncLock.RUnlock()
+	// the candidates are never changed once synced, they are filtered out of the lock as it goes to Redis
+	candidates = filterCandidates(candidates, model, capabilities)
+	if len(candidates) == 0 {
+		return nil, errors.New("channel not found")
 	}
-	return channels[idx], nil
+	return pickCandidate(candidates, ignoreFirstPriority).channel, nil
 }
 
 func CacheGetModelList() ([]string, error) {
@@ -0,0 +1,164 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ramp raises the weight of a model row step by step, until the target is reached
+// or the error rate of the channel for the model exceeds the threshold
+type Ramp struct {
+	Step         int     `json:"step"`
+	Interval     int     `json:"interval"` // unit is minute
+	Target       int     `json:"target"`
+	MaxErrorRate float64 `json:"max_error_rate"` // from 0 to 1, 0 means never halt
+	MinRequests  int     `json:"min_requests"`   // the error rate is not trusted below this number of requests
+	LastStepTime int64   `json:"last_step_time"`
+	Halted       bool    `json:"halted"`
+}
+
+// sameSchedule reports whether both ramps are configured alike, regardless of their progress
+func (r *Ramp) sameSchedule(other *Ramp) bool {
+	return r.Step == other.Step && r.Interval == other.Interval && r.Target == other.Target &&
+		r.MaxErrorRate == other.MaxErrorRate && r.MinRequests == other.MinRequests
+}
+
+type relayStats struct {
+	total  int
+	failed int
+}
+
+var channelModelStats = make(map[string]*relayStats)
+var channelModelStatsLock sync.Mutex
+
+func relayStatsKey(channelId int, model string) string {
+	return fmt.Sprintf("channel_stats:%d:%s", channelId, model)
+}
+
+// RecordRelayResult counts the requests and failures of the channel for the model, for the ramp schedules
+func RecordRelayResult(channelId int, model string, success bool) {
+	key := relayStatsKey(channelId, model)
+	if common.RedisEnabled {
+		ctx := context.Background()
+		pipe := common.RDB.TxPipeline()
+		pipe.HIncrBy(ctx, key, "total", 1)
+		if !success {
+			pipe.HIncrBy(ctx, key, "failed", 1)
+		}
+		pipe.Expire(ctx, key, 24*time.Hour)
+		_, err := pipe.Exec(ctx)
+		if err != nil {
+			logger.SysError("Redis record relay result error: " + err.Error())
+		}
+		return
+	}
+	channelModelStatsLock.Lock()
+	defer channelModelStatsLock.Unlock()
+	stats, ok := channelModelStats[key]
+	if !ok {
+		stats = &relayStats{}
+		channelModelStats[key] = stats
+	}
+	stats.total++
+	if !success {
+		stats.failed++
+	}
+}
+
+// popRelayStats returns the counters since the last call and resets them
+func popRelayStats(channelId int, model string) (total int, failed int) {
+	key := relayStatsKey(channelId, model)
+	if common.RedisEnabled {
+		ctx := context.Background()
+		pipe := common.RDB.TxPipeline()
+		values := pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		_, err := pipe.Exec(ctx)
+		if err != nil {
+			logger.SysError("Redis get relay stats error: " + err.Error())
+			return 0, 0
+		}
+		total, _ = strconv.Atoi(values.Val()["total"])
+		failed, _ = strconv.Atoi(values.Val()["failed"])
+		return total, failed
+	}
+	channelModelStatsLock.Lock()
+	defer channelModelStatsLock.Unlock()
+	stats, ok := channelModelStats[key]
+	if !ok {
+		return 0, 0
+	}
+	delete(channelModelStats, key)
+	return stats.total, stats.failed
+}
+
+// stepRamp moves the ramp of the model row forward if its interval has elapsed, it reports whether the row changed
+func stepRamp(m *Model, now time.Time) bool {
+	ramp := m.Ramp
+	if ramp == nil || ramp.Halted || ramp.Step <= 0 || m.GetWeight() >= ramp.Target {
+		return false
+	}
+	if ramp.LastStepTime == 0 {
+		// the schedule starts now, the first step is taken after a full interval
+		ramp.LastStepTime = now.Unix()
+		popRelayStats(m.ChannelId, m.MappedName)
+		return true
+	}
+	if now.Sub(time.Unix(ramp.LastStepTime, 0)) < time.Duration(ramp.Interval)*time.Minute {
+		return false
+	}
+	total, failed := popRelayStats(m.ChannelId, m.MappedName)
+	ramp.LastStepTime = now.Unix()
+	if ramp.MaxErrorRate > 0 && total > 0 && total >= ramp.MinRequests {
+		errorRate := float64(failed) / float64(total)
+		if errorRate > ramp.MaxErrorRate {
+			ramp.Halted = true
+			logger.SysLogf("ramp of model %s on channel #%d halted at weight %d, error rate %.2f%% in %d requests",
+				m.MappedName, m.ChannelId, m.GetWeight(), errorRate*100, total)
+			return true
+		}
+	}
+	weight := min(m.GetWeight()+ramp.Step, ramp.Target)
+	m.Weight = &weight
+	logger.SysLogf("ramping model %s on channel #%d to weight %d", m.MappedName, m.ChannelId, weight)
+	return true
+}
+
+func rampModels() {
+	var models []*Model
+	err := DB.Find(&models).Error
+	if err != nil {
+		logger.SysError("failed to get ramping models: " + err.Error())
+		return
+	}
+	now := time.Now()
+	changed := false
+	for _, m := range models {
+		if m.Ramp == nil || !stepRamp(m, now) {
+			continue
+		}
+		err = DB.Model(m).Select("weight", "ramp").Updates(m).Error
+		if err != nil {
+			logger.SysError("failed to update model ramp: " + err.Error())
+			continue
+		}
+		changed = true
+	}
+	if changed && config.MemoryCacheEnabled {
+		InitChannelCache()
+	}
+}
+
+// SyncRampSchedules moves the ramp schedules forward every minute, it must only run on the master node
+func SyncRampSchedules() {
+	for {
+		time.Sleep(time.Minute)
+		rampModels()
+	}
+}
@@ -0,0 +1,144 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestStepRamp(t *testing.T) {
+	newModel := func() *Model {
+		return &Model{
+			ChannelId:  -1,
+			MappedName: "ramp-test",
+			Weight:     intPtr(10),
+			Ramp:       &Ramp{Step: 20, Interval: 10, Target: 45, MaxErrorRate: 0.5, MinRequests: 4},
+		}
+	}
+	start := time.Unix(1_700_000_000, 0)
+
+	m := newModel()
+	if !stepRamp(m, start) || m.Ramp.LastStepTime != start.Unix() || m.GetWeight() != 10 {
+		t.Fatalf("the schedule didn't start without a step: weight %d, last step %d", m.GetWeight(), m.Ramp.LastStepTime)
+	}
+	if stepRamp(m, start.Add(9*time.Minute)) {
+		t.Fatalf("stepped before the interval elapsed")
+	}
+	if !stepRamp(m, start.Add(10*time.Minute)) || m.GetWeight() != 30 {
+		t.Fatalf("weight after a step = %d, want 30", m.GetWeight())
+	}
+	if !stepRamp(m, start.Add(20*time.Minute)) || m.GetWeight() != 45 {
+		t.Fatalf("weight after the last step = %d, want the target 45", m.GetWeight())
+	}
+	if stepRamp(m, start.Add(30*time.Minute)) {
+		t.Fatalf("stepped past the target")
+	}
+
+	m = newModel()
+	stepRamp(m, start)
+	for i := 0; i < 4; i++ {
+		RecordRelayResult(m.ChannelId, m.MappedName, i == 0)
+	}
+	if !stepRamp(m, start.Add(10*time.Minute)) || !m.Ramp.Halted || m.GetWeight() != 10 {
+		t.Fatalf("the ramp wasn't halted at an error rate of 75%%: halted %v, weight %d", m.Ramp.Halted, m.GetWeight())
+	}
+	if stepRamp(m, start.Add(20*time.Minute)) {
+		t.Fatalf("a halted ramp stepped")
+	}
+
+	m = newModel()
+	stepRamp(m, start)
+	// too few requests to trust the error rate
+	RecordRelayResult(m.ChannelId, m.MappedName, false)
+	if !stepRamp(m, start.Add(10*time.Minute)) || m.Ramp.Halted || m.GetWeight() != 30 {
+		t.Fatalf("the ramp didn't step below the minimum requests: halted %v, weight %d", m.Ramp.Halted, m.GetWeight())
+	}
+}
+
+func TestUpdateModelsKeepsState(t *testing.T) {
+	setupTestDB(t)
+	channel := &Channel{Name: "canary", Key: "sk-test", Status: ChannelStatusEnabled}
+	channel.Models = []*Model{
+		{Name: "gpt-4o", MappedName: "gpt-4o", Weight: intPtr(10), Ramp: &Ramp{Step: 10, Interval: 5, Target: 100}},
+		{Name: "gpt-4o-mini", MappedName: "gpt-4o-mini"},
+		{Name: "o1", MappedName: "o1"},
+	}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ramp made progress and the price sync flagged a row since
+	err = DB.Model(&Model{}).Where("name = ?", "gpt-4o").Updates(map[string]any{
+		"weight": 40,
+		"ramp":   `{"step":10,"interval":5,"target":100,"last_step_time":1700000000}`,
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.Model(&Model{}).Where("name = ?", "gpt-4o-mini").Update("upstream_missing", true).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldModels, err := GetModelByChannel(channel.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldIds := make(map[string]int)
+	for _, m := range oldModels {
+		oldIds[m.Name] = m.Id
+	}
+
+	// the form sends back the rows as it loaded them, with o1 removed and o3 added
+	channel.Models = []*Model{
+		{Name: "gpt-4o", MappedName: "gpt-4o-canary", Weight: intPtr(10), Ramp: &Ramp{Step: 10, Interval: 5, Target: 100}},
+		{Name: "gpt-4o-mini", MappedName: "gpt-4o-mini"},
+		{Name: "o3", MappedName: "o3"},
+	}
+	err = channel.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	models, err := GetModelByChannel(channel.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name2Model := make(map[string]*Model)
+	for _, m := range models {
+		name2Model[m.Name] = m
+	}
+	if len(models) != 3 || name2Model["o1"] != nil || name2Model["o3"] == nil {
+		t.Fatalf("models after the update = %v, want gpt-4o, gpt-4o-mini and o3", name2Model)
+	}
+	canary := name2Model["gpt-4o"]
+	if canary.Id != oldIds["gpt-4o"] || name2Model["gpt-4o-mini"].Id != oldIds["gpt-4o-mini"] {
+		t.Errorf("the matched rows got new ids")
+	}
+	if canary.MappedName != "gpt-4o-canary" {
+		t.Errorf("mapped name = %q, want the edited one", canary.MappedName)
+	}
+	if canary.GetWeight() != 40 || canary.Ramp == nil || canary.Ramp.LastStepTime != 1700000000 {
+		t.Errorf("the ramp was reset: weight %d, ramp %+v", canary.GetWeight(), canary.Ramp)
+	}
+	if !name2Model["gpt-4o-mini"].UpstreamMissing {
+		t.Errorf("the upstream missing flag was reset")
+	}
+
+	// a new schedule replaces the ramp
+	channel.Models = []*Model{
+		{Name: "gpt-4o", MappedName: "gpt-4o", Weight: intPtr(20), Ramp: &Ramp{Step: 20, Interval: 5, Target: 100}},
+	}
+	err = channel.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	models, err = GetModelByChannel(channel.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 1 || models[0].GetWeight() != 20 || models[0].Ramp.Step != 20 || models[0].Ramp.LastStepTime != 0 {
+		t.Errorf("the new ramp wasn't applied: %+v", models)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/helper"
 	"github.com/eloxt/llmhub/common/logger"
+	"slices"
 	"time"
 
 	"gorm.io/gorm"
@@ -30,7 +31,15 @@ type Channel struct {
 	Priority     *int64    `json:"priority" gorm:"bigint;default:0"`
 	Config       string    `json:"config"`
 	SystemPrompt *string   `json:"system_prompt" gorm:"type:text"`
-	Models       []*Model  `json:"models" gorm:"-:all"`
+	// MaxConcurrency is the number of requests the upstream accepts at the same time, 0 means unlimited
+	MaxConcurrency *int `json:"max_concurrency" gorm:"default:0"`
+	// Groups is a comma separated list of the user groups allowed to use the channel
+	Groups string `json:"groups" gorm:"type:varchar(255);default:'default'"`
+	// ParamPolicy is applied to the requests after the one of the token
+	ParamPolicy ParamPolicy                `json:"param_policy" gorm:"type:text;serializer:json"`
+	InFlight    int                        `json:"in_flight" gorm:"-:all"`
+	RateLimits  map[string]*RateLimitState `json:"rate_limits,omitempty" gorm:"-:all"`
+	Models      []*Model                   `json:"models" gorm:"-:all"`
 }
 
 type ChannelConfig struct {
@@ -45,14 +54,13 @@ type ChannelConfig struct {
 	VertexAIADC       string `json:"vertex_ai_adc,omitempty"`
 }
 
-func GetAllChannels(startIdx int, num int, scope string, keyword string) ([]*Channel, int64, error) {
+// GetAllChannels lists the channels for the admin, their secrets are always redacted,
+// GetEnabledChannels and GetChannelById are there for the code which needs them
+func GetAllChannels(startIdx int, num int, keyword string) ([]*Channel, int64, error) {
 	var channels []*Channel
 	var err error
 	var total int64
-	var tx = DB
-	if scope != "all" {
-		tx.Omit("key")
-	}
+	var tx = DB.Omit("key")
 	if keyword != "" {
 		tx = tx.Where("id = ? or name LIKE ?", helper.String2Int(keyword), keyword+"%")
 	}
@@ -61,9 +69,18 @@ func GetAllChannels(startIdx int, num int, scope string, keyword string) ([]*Cha
 		return nil, 0, err
 	}
 	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&channels).Error
+	for _, channel := range channels {
+		channel.RedactSecrets()
+	}
 	return channels, total, err
 }
 
+func GetEnabledChannels() ([]*Channel, error) {
+	var channels []*Channel
+	err := DB.Where("status = ?", ChannelStatusEnabled).Find(&channels).Error
+	return channels, err
+}
+
 func GetChannelById(id int, selectAll bool) (*Channel, error) {
 	channel := Channel{Id: id}
 	var err error = nil
@@ -71,6 +88,7 @@ func GetChannelById(id int, selectAll bool) (*Channel, error) {
 		err = DB.First(&channel, "id = ?", id).Error
 	} else {
 		err = DB.Omit("key").First(&channel, "id = ?", id).Error
+		channel.RedactSecrets()
 	}
 	return &channel, err
 }
@@ -97,6 +115,21 @@ func (channel *Channel) GetPriority() int64 {
 	return *channel.Priority
 }
 
+func (channel *Channel) GetMaxConcurrency() int {
+	if channel.MaxConcurrency == nil {
+		return 0
+	}
+	return *channel.MaxConcurrency
+}
+
+func (channel *Channel) GetGroups() []string {
+	return SplitGroups(channel.Groups)
+}
+
+func (channel *Channel) HasGroup(group string) bool {
+	return slices.Contains(channel.GetGroups(), group)
+}
+
 func (channel *Channel) GetBaseURL() string {
 	if channel.BaseURL == nil {
 		return ""
@@ -116,6 +149,16 @@ func (channel *Channel) Insert() error {
 
 func (channel *Channel) Update() error {
 	var err error
+	if channel.Config != "" {
+		oldChannel, err := GetChannelById(channel.Id, true)
+		if err != nil {
+			return err
+		}
+		err = channel.keepConfigSecrets(oldChannel)
+		if err != nil {
+			return err
+		}
+	}
 	err = DB.Model(channel).Updates(channel).Error
 	if err != nil {
 		return err
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// an encrypted secret is enc:v1:<master key id>:<data key sealed by the master key>:<secret sealed by the data key>
+const channelSecretPrefix = "enc:v1:"
+
+type masterKey struct {
+	id  string
+	key []byte
+}
+
+func newMasterKey(secret string) *masterKey {
+	key := sha256.Sum256([]byte(secret))
+	id := sha256.Sum256(key[:])
+	return &masterKey{id: hex.EncodeToString(id[:4]), key: key[:]}
+}
+
+var currentMasterKey *masterKey
+var masterKeys map[string]*masterKey
+var masterKeysOnce sync.Once
+
+func loadMasterKeys() {
+	masterKeysOnce.Do(func() {
+		masterKeys = make(map[string]*masterKey)
+		if config.ChannelOldMasterKey != "" {
+			oldKey := newMasterKey(config.ChannelOldMasterKey)
+			masterKeys[oldKey.id] = oldKey
+		}
+		if config.ChannelMasterKey != "" {
+			currentMasterKey = newMasterKey(config.ChannelMasterKey)
+			masterKeys[currentMasterKey.id] = currentMasterKey
+		} else {
+			logger.SysError("CHANNEL_MASTER_KEY is not set, the channel secrets are stored in plaintext")
+		}
+	})
+}
+
+func encryptChannelSecret(plaintext string) (string, error) {
+	loadMasterKeys()
+	if plaintext == "" || currentMasterKey == nil || strings.HasPrefix(plaintext, channelSecretPrefix) {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedKey, err := common.AesGcmEncrypt(currentMasterKey.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedSecret, err := common.AesGcmEncrypt(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return channelSecretPrefix + currentMasterKey.id + ":" +
+		base64.StdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.StdEncoding.EncodeToString(sealedSecret), nil
+}
+
+// decryptChannelSecret returns the values stored before the encryption as they are
+func decryptChannelSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, channelSecretPrefix) {
+		return value, nil
+	}
+	loadMasterKeys()
+	parts := strings.Split(strings.TrimPrefix(value, channelSecretPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed channel secret")
+	}
+	key, ok := masterKeys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown master key %s", parts[0])
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	sealedSecret, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := common.AesGcmDecrypt(key.key, sealedKey)
+	if err != nil {
+		return "", err
+	}
+	secret, err := common.AesGcmDecrypt(dataKey, sealedSecret)
+	return string(secret), err
+}
+
+// updateSecrets applies f to the key and the secrets in the config
+func (channel *Channel) updateSecrets(f func(string) (string, error)) error {
+	var err error
+	channel.Key, err = f(channel.Key)
+	if err != nil {
+		return err
+	}
+	if channel.Config == "" {
+		return nil
+	}
+	cfg, err := channel.LoadConfig()
+	if err != nil {
+		// not ours to fix here
+		return nil
+	}
+	for _, secret := range []*string{&cfg.SK, &cfg.AK, &cfg.VertexAIADC} {
+		*secret, err = f(*secret)
+		if err != nil {
+			return err
+		}
+	}
+	jsonBytes, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	channel.Config = string(jsonBytes)
+	return nil
+}
+
+func (channel *Channel) BeforeSave(tx *gorm.DB) error {
+	return channel.updateSecrets(encryptChannelSecret)
+}
+
+// AfterSave gives the plaintext back to the caller
+func (channel *Channel) AfterSave(tx *gorm.DB) error {
+	return channel.AfterFind(tx)
+}
+
+func (channel *Channel) AfterFind(tx *gorm.DB) error {
+	err := channel.updateSecrets(decryptChannelSecret)
+	if err != nil {
+		// the channel is unusable, but the others must still be loaded
+		logger.SysError(fmt.Sprintf("failed to decrypt the secrets of channel #%d: %s", channel.Id, err.Error()))
+	}
+	return nil
+}
+
+// RedactSecrets clears the key and the secrets in the config, the admin API never returns them
+func (channel *Channel) RedactSecrets() {
+	_ = channel.updateSecrets(func(string) (string, error) {
+		return "", nil
+	})
+}
+
+// keepConfigSecrets fills the secrets left empty by the admin, as they are never sent to the admin in the first place
+func (channel *Channel) keepConfigSecrets(oldChannel *Channel) error {
+	cfg, err := channel.LoadConfig()
+	if err != nil {
+		return err
+	}
+	oldCfg, err := oldChannel.LoadConfig()
+	if err != nil {
+		return nil
+	}
+	if cfg.SK == "" {
+		cfg.SK = oldCfg.SK
+	}
+	if cfg.AK == "" {
+		cfg.AK = oldCfg.AK
+	}
+	if cfg.VertexAIADC == "" {
+		cfg.VertexAIADC = oldCfg.VertexAIADC
+	}
+	jsonBytes, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	channel.Config = string(jsonBytes)
+	return nil
+}
+
+// RotateChannelKeys re-encrypts the secrets of all the channels with the current master key,
+// CHANNEL_OLD_MASTER_KEY must be set to the previous one. The plaintext secrets get encrypted as well.
+func RotateChannelKeys() error {
+	loadMasterKeys()
+	if currentMasterKey == nil {
+		return errors.New("CHANNEL_MASTER_KEY is not set")
+	}
+	var channels []*Channel
+	err := DB.Find(&channels).Error
+	if err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		// the secrets which could not be decrypted are still encrypted here
+		err = channel.updateSecrets(decryptChannelSecret)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the secrets of channel #%d: %w", channel.Id, err)
+		}
+		err = DB.Model(channel).Select("key", "config").Updates(channel).Error
+		if err != nil {
+			return fmt.Errorf("failed to update channel #%d: %w", channel.Id, err)
+		}
+	}
+	logger.SysLogf("secrets of %d channels re-encrypted", len(channels))
+	return nil
+}
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"github.com/eloxt/llmhub/common/config"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setTestMasterKeys reloads the master keys from the given secrets, and the previous ones after the test
+func setTestMasterKeys(t *testing.T, current string, old string) {
+	t.Helper()
+	savedCurrent, savedOld := config.ChannelMasterKey, config.ChannelOldMasterKey
+	t.Cleanup(func() {
+		config.ChannelMasterKey, config.ChannelOldMasterKey = savedCurrent, savedOld
+		currentMasterKey = nil
+		masterKeysOnce = sync.Once{}
+	})
+	config.ChannelMasterKey, config.ChannelOldMasterKey = current, old
+	currentMasterKey = nil
+	masterKeysOnce = sync.Once{}
+}
+
+func getStoredChannel(t *testing.T, id int) (key string, cfg string) {
+	t.Helper()
+	row := DB.Table("channels").Select("key", "config").Where("id = ?", id).Row()
+	err := row.Scan(&key, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cfg
+}
+
+func TestChannelSecretRoundTrip(t *testing.T) {
+	setTestMasterKeys(t, "master-key", "")
+	encrypted, err := encryptChannelSecret("sk-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, channelSecretPrefix) || strings.Contains(encrypted, "sk-secret") {
+		t.Fatalf("secret not encrypted: %s", encrypted)
+	}
+	again, _ := encryptChannelSecret(encrypted)
+	if again != encrypted {
+		t.Errorf("an encrypted secret was encrypted twice")
+	}
+	decrypted, err := decryptChannelSecret(encrypted)
+	if err != nil || decrypted != "sk-secret" {
+		t.Errorf("decrypted = %q, %v, want sk-secret", decrypted, err)
+	}
+	// the secrets stored before the encryption are read as they are
+	plaintext, err := decryptChannelSecret("sk-plain")
+	if err != nil || plaintext != "sk-plain" {
+		t.Errorf("plaintext = %q, %v, want sk-plain", plaintext, err)
+	}
+
+	setTestMasterKeys(t, "another-key", "")
+	if _, err := decryptChannelSecret(encrypted); err == nil {
+		t.Errorf("decrypted with an unknown master key")
+	}
+}
+
+func TestChannelSecretsAtRest(t *testing.T) {
+	setupTestDB(t)
+	setTestMasterKeys(t, "master-key", "")
+	channel := &Channel{Name: "secret", Key: "sk-secret", Config: `{"sk":"secret-sk","region":"us-east-1"}`}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Key != "sk-secret" {
+		t.Errorf("key after the insert = %q, want the plaintext", channel.Key)
+	}
+	key, cfg := getStoredChannel(t, channel.Id)
+	if !strings.HasPrefix(key, channelSecretPrefix) || strings.Contains(cfg, "secret-sk") || !strings.Contains(cfg, "us-east-1") {
+		t.Errorf("secrets stored in plaintext: key %s, config %s", key, cfg)
+	}
+
+	loaded, err := GetChannelById(channel.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedCfg, _ := loaded.LoadConfig()
+	if loaded.Key != "sk-secret" || loadedCfg.SK != "secret-sk" {
+		t.Errorf("loaded key %q and sk %q, want the plaintext", loaded.Key, loadedCfg.SK)
+	}
+
+	channels, _, err := GetAllChannels(0, 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listedCfg, _ := channels[0].LoadConfig()
+	if channels[0].Key != "" || listedCfg.SK != "" || listedCfg.Region != "us-east-1" {
+		t.Errorf("listed key %q and config %s, want the secrets redacted", channels[0].Key, channels[0].Config)
+	}
+}
+
+func TestRotateChannelKeys(t *testing.T) {
+	setupTestDB(t)
+	setTestMasterKeys(t, "old-key", "")
+	channel := &Channel{Name: "secret", Key: "sk-secret"}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStored, _ := getStoredChannel(t, channel.Id)
+
+	setTestMasterKeys(t, "new-key", "old-key")
+	err = RotateChannelKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newStored, _ := getStoredChannel(t, channel.Id)
+	if newStored == oldStored || !strings.HasPrefix(newStored, channelSecretPrefix+newMasterKey("new-key").id+":") {
+		t.Errorf("secret not re-encrypted with the new master key: %s", newStored)
+	}
+
+	// the old master key is not needed any more
+	setTestMasterKeys(t, "new-key", "")
+	loaded, err := GetChannelById(channel.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Key != "sk-secret" {
+		t.Errorf("key after the rotation = %q, want sk-secret", loaded.Key)
+	}
+}
@@ -0,0 +1,257 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var ErrChannelBusy = errors.New("channel is busy")
+
+// the slot is kept for at most an hour, in case an instance died without releasing it
+var acquireScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if current >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("INCR", KEYS[1])
+redis.call("EXPIRE", KEYS[1], 3600)
+return 1
+`)
+
+var releaseScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if current > 0 then
+	redis.call("DECR", KEYS[1])
+end
+return 1
+`)
+
+// channelLimiter counts the in-flight requests of a channel. The waiters are served in FIFO order,
+// only the head of the queue tries to take a slot, and it is woken up whenever a slot is released.
+// With Redis the counter is shared by all instances, the order is kept within an instance.
+type channelLimiter struct {
+	mutex    sync.Mutex
+	inFlight int
+	waiters  []chan struct{}
+}
+
+var channelLimiters = make(map[int]*channelLimiter)
+var channelLimitersLock sync.Mutex
+
+func getChannelLimiter(channelId int) *channelLimiter {
+	channelLimitersLock.Lock()
+	defer channelLimitersLock.Unlock()
+	limiter, ok := channelLimiters[channelId]
+	if !ok {
+		limiter = &channelLimiter{}
+		channelLimiters[channelId] = limiter
+	}
+	return limiter
+}
+
+func inFlightKey(channelId int) string {
+	return fmt.Sprintf("channel_in_flight:%d", channelId)
+}
+
+// tryAcquire must be called with the mutex held
+func (l *channelLimiter) tryAcquire(channelId int, maxConcurrency int) bool {
+	if !common.RedisEnabled {
+		if l.inFlight >= maxConcurrency {
+			return false
+		}
+		l.inFlight++
+		return true
+	}
+	ok, err := acquireScript.Run(context.Background(), common.RDB, []string{inFlightKey(channelId)}, maxConcurrency).Int()
+	if err != nil {
+		// don't block the traffic because of Redis
+		logger.SysError("Redis acquire channel slot error: " + err.Error())
+		return true
+	}
+	return ok == 1
+}
+
+// wakeHead must be called with the mutex held
+func (l *channelLimiter) wakeHead() {
+	if len(l.waiters) == 0 {
+		return
+	}
+	select {
+	case l.waiters[0] <- struct{}{}:
+	default:
+	}
+}
+
+func (l *channelLimiter) release(channelId int) {
+	if common.RedisEnabled {
+		err := releaseScript.Run(context.Background(), common.RDB, []string{inFlightKey(channelId)}).Err()
+		if err != nil {
+			logger.SysError("Redis release channel slot error: " + err.Error())
+		}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !common.RedisEnabled && l.inFlight > 0 {
+		l.inFlight--
+	}
+	l.wakeHead()
+}
+
+func (l *channelLimiter) removeWaiter(waiter chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	idx := slices.Index(l.waiters, waiter)
+	if idx < 0 {
+		return
+	}
+	l.waiters = slices.Delete(l.waiters, idx, idx+1)
+	if idx == 0 {
+		l.wakeHead()
+	}
+}
+
+// AcquireChannel takes a slot of the channel, waiting in the queue if the channel is saturated.
+// The returned function releases the slot. ErrChannelBusy is returned when the queue is full or the wait timed out.
+func AcquireChannel(ctx context.Context, channelId int, maxConcurrency int) (func(), error) {
+	if maxConcurrency <= 0 {
+		return func() {}, nil
+	}
+	limiter := getChannelLimiter(channelId)
+	release := func() {
+		limiter.release(channelId)
+	}
+	limiter.mutex.Lock()
+	if len(limiter.waiters) == 0 && limiter.tryAcquire(channelId, maxConcurrency) {
+		limiter.mutex.Unlock()
+		return release, nil
+	}
+	if len(limiter.waiters) >= config.ChannelQueueLength {
+		limiter.mutex.Unlock()
+		return nil, ErrChannelBusy
+	}
+	waiter := make(chan struct{}, 1)
+	limiter.waiters = append(limiter.waiters, waiter)
+	limiter.mutex.Unlock()
+
+	timer := time.NewTimer(time.Duration(config.ChannelQueueTimeout) * time.Second)
+	defer timer.Stop()
+	// slots released by other instances are not notified, poll for them
+	var poll <-chan time.Time
+	if common.RedisEnabled {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-waiter:
+		case <-poll:
+		case <-timer.C:
+			limiter.removeWaiter(waiter)
+			return nil, ErrChannelBusy
+		case <-ctx.Done():
+			limiter.removeWaiter(waiter)
+			return nil, ctx.Err()
+		}
+		limiter.mutex.Lock()
+		if limiter.waiters[0] == waiter && limiter.tryAcquire(channelId, maxConcurrency) {
+			limiter.waiters = limiter.waiters[1:]
+			// there may be more free slots
+			limiter.wakeHead()
+			limiter.mutex.Unlock()
+			return release, nil
+		}
+		limiter.mutex.Unlock()
+	}
+}
+
+// TryAcquireChannel takes a slot of the channel only if one is free right now
+func TryAcquireChannel(channelId int, maxConcurrency int) (func(), bool) {
+	if maxConcurrency <= 0 {
+		return func() {}, true
+	}
+	limiter := getChannelLimiter(channelId)
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if len(limiter.waiters) != 0 || !limiter.tryAcquire(channelId, maxConcurrency) {
+		return nil, false
+	}
+	return func() {
+		limiter.release(channelId)
+	}, true
+}
+
+// GetChannelInFlight returns the number of requests being served by the channel
+func GetChannelInFlight(channelId int) int {
+	return getChannelsInFlight([]int{channelId})[channelId]
+}
+
+// getChannelsInFlight returns the number of requests being served by each channel, with a single MGET with Redis
+func getChannelsInFlight(channelIds []int) map[int]int {
+	inFlight := make(map[int]int, len(channelIds))
+	if len(channelIds) == 0 {
+		return inFlight
+	}
+	if !common.RedisEnabled {
+		for _, channelId := range channelIds {
+			limiter := getChannelLimiter(channelId)
+			limiter.mutex.Lock()
+			inFlight[channelId] = limiter.inFlight
+			limiter.mutex.Unlock()
+		}
+		return inFlight
+	}
+	keys := make([]string, 0, len(channelIds))
+	for _, channelId := range channelIds {
+		keys = append(keys, inFlightKey(channelId))
+	}
+	values, err := common.RDB.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		// the channels are taken as free rather than blocking the traffic because of Redis
+		logger.SysError("Redis get channel in flight error: " + err.Error())
+		return inFlight
+	}
+	for i, value := range values {
+		if value, ok := value.(string); ok {
+			inFlight[channelIds[i]], _ = strconv.Atoi(value)
+		}
+	}
+	return inFlight
+}
+
+// filterSaturated returns the candidates whose channel would serve a new request at once
+func filterSaturated(candidates []*channelCandidate) []*channelCandidate {
+	channelIds := make([]int, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.channel.GetMaxConcurrency() > 0 {
+			channelIds = append(channelIds, candidate.channel.Id)
+		}
+	}
+	inFlight := getChannelsInFlight(channelIds)
+	available := make([]*channelCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		maxConcurrency := candidate.channel.GetMaxConcurrency()
+		if maxConcurrency <= 0 {
+			available = append(available, candidate)
+			continue
+		}
+		limiter := getChannelLimiter(candidate.channel.Id)
+		limiter.mutex.Lock()
+		waiting := len(limiter.waiters)
+		limiter.mutex.Unlock()
+		if waiting == 0 && inFlight[candidate.channel.Id] < maxConcurrency {
+			available = append(available, candidate)
+		}
+	}
+	return available
+}
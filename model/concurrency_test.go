@@ -0,0 +1,127 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
+	"testing"
+	"time"
+)
+
+func setChannelQueue(t *testing.T, length int, timeout int) {
+	t.Helper()
+	common.RedisEnabled = false
+	savedLength, savedTimeout := config.ChannelQueueLength, config.ChannelQueueTimeout
+	config.ChannelQueueLength, config.ChannelQueueTimeout = length, timeout
+	t.Cleanup(func() {
+		config.ChannelQueueLength, config.ChannelQueueTimeout = savedLength, savedTimeout
+	})
+}
+
+// waitForWaiters blocks until the queue of the channel has n requests
+func waitForWaiters(t *testing.T, channelId int, n int) {
+	t.Helper()
+	limiter := getChannelLimiter(channelId)
+	for i := 0; i < 100; i++ {
+		limiter.mutex.Lock()
+		waiting := len(limiter.waiters)
+		limiter.mutex.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the queue of channel #%d never reached %d requests", channelId, n)
+}
+
+func TestAcquireChannelQueue(t *testing.T) {
+	setChannelQueue(t, 2, 5)
+	const channelId = -301
+	ctx := context.Background()
+	release, err := AcquireChannel(ctx, channelId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetChannelInFlight(channelId) != 1 {
+		t.Errorf("in flight = %d, want 1", GetChannelInFlight(channelId))
+	}
+
+	// the waiters are served in the order they came
+	served := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func() {
+			release, err := AcquireChannel(ctx, channelId, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			served <- i
+			release()
+		}()
+		waitForWaiters(t, channelId, i)
+	}
+	if _, err := AcquireChannel(ctx, channelId, 1); !errors.Is(err, ErrChannelBusy) {
+		t.Errorf("AcquireChannel() with a full queue = %v, want ErrChannelBusy", err)
+	}
+	if _, ok := TryAcquireChannel(channelId, 1); ok {
+		t.Errorf("TryAcquireChannel() took the slot of a saturated channel")
+	}
+
+	release()
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-served:
+			if got != want {
+				t.Errorf("waiter %d served before waiter %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("waiter %d was never served", want)
+		}
+	}
+	waitForWaiters(t, channelId, 0)
+	release, ok := TryAcquireChannel(channelId, 1)
+	if !ok {
+		t.Fatalf("TryAcquireChannel() failed on a free channel")
+	}
+	release()
+}
+
+func TestAcquireChannelGivesUp(t *testing.T) {
+	setChannelQueue(t, 4, 1)
+	const channelId = -302
+	release, err := AcquireChannel(context.Background(), channelId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	start := time.Now()
+	if _, err := AcquireChannel(context.Background(), channelId, 1); !errors.Is(err, ErrChannelBusy) {
+		t.Errorf("AcquireChannel() after the queue timeout = %v, want ErrChannelBusy", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("gave up after %s, before the queue timeout", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireChannel(ctx, channelId, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcquireChannel() with a cancelled request = %v, want its error", err)
+	}
+	// the requests which gave up left the queue
+	waitForWaiters(t, channelId, 0)
+}
+
+func TestAcquireChannelUnlimited(t *testing.T) {
+	setChannelQueue(t, 0, 1)
+	const channelId = -303
+	for i := 0; i < 3; i++ {
+		if _, err := AcquireChannel(context.Background(), channelId, 0); err != nil {
+			t.Fatalf("AcquireChannel() on a channel without limit = %v", err)
+		}
+	}
+	if GetChannelInFlight(channelId) != 0 {
+		t.Errorf("requests counted on a channel without limit")
+	}
+}
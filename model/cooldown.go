@@ -0,0 +1,135 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitState is what the upstream told us about its rate limits for a channel and model
+type RateLimitState struct {
+	CooldownUntil     time.Time `json:"cooldown_until"`
+	RemainingRequests int       `json:"remaining_requests"` // -1 means unknown
+	RemainingTokens   int       `json:"remaining_tokens"`   // -1 means unknown
+	RequestsResetAt   time.Time `json:"requests_reset_at"`
+	TokensResetAt     time.Time `json:"tokens_reset_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+var rateLimitStates = make(map[string]*RateLimitState)
+var rateLimitStatesLock sync.RWMutex
+
+func rateLimitKey(channelId int, model string) string {
+	return fmt.Sprintf("%d:%s", channelId, model)
+}
+
+// the model is the hash tag, so the keys of a selection are in the same slot of a Redis cluster
+func cooldownKey(channelId int, model string) string {
+	return fmt.Sprintf("channel_cooldown:{%s}:%d", model, channelId)
+}
+
+// exhausted reports whether the upstream is not going to accept the request until a reset
+func (state *RateLimitState) exhausted(now time.Time) bool {
+	if now.Before(state.CooldownUntil) {
+		return true
+	}
+	if state.RemainingRequests == 0 && now.Before(state.RequestsResetAt) {
+		return true
+	}
+	if state.RemainingTokens == 0 && now.Before(state.TokensResetAt) {
+		return true
+	}
+	return false
+}
+
+// SetChannelCooldown keeps the channel out of the selection for the model until the given time
+func SetChannelCooldown(channelId int, model string, until time.Time) {
+	rateLimitStatesLock.Lock()
+	state, ok := rateLimitStates[rateLimitKey(channelId, model)]
+	if !ok {
+		state = &RateLimitState{RemainingRequests: -1, RemainingTokens: -1}
+		rateLimitStates[rateLimitKey(channelId, model)] = state
+	}
+	if until.After(state.CooldownUntil) {
+		state.CooldownUntil = until
+	}
+	state.UpdatedAt = time.Now()
+	rateLimitStatesLock.Unlock()
+	if common.RedisEnabled && time.Until(until) > 0 {
+		err := common.RedisSet(cooldownKey(channelId, model), "1", time.Until(until))
+		if err != nil {
+			logger.SysError("Redis set channel cooldown error: " + err.Error())
+		}
+	}
+}
+
+// RecordChannelRateLimit saves the remaining requests and tokens reported by the upstream
+func RecordChannelRateLimit(channelId int, model string, remainingRequests int, requestsResetAt time.Time, remainingTokens int, tokensResetAt time.Time) {
+	rateLimitStatesLock.Lock()
+	defer rateLimitStatesLock.Unlock()
+	state, ok := rateLimitStates[rateLimitKey(channelId, model)]
+	if !ok {
+		state = &RateLimitState{}
+		rateLimitStates[rateLimitKey(channelId, model)] = state
+	}
+	state.RemainingRequests = remainingRequests
+	state.RequestsResetAt = requestsResetAt
+	state.RemainingTokens = remainingTokens
+	state.TokensResetAt = tokensResetAt
+	state.UpdatedAt = time.Now()
+}
+
+// GetChannelRateLimits returns the known rate limit states of the channel, keyed by model
+func GetChannelRateLimits(channelId int) map[string]*RateLimitState {
+	prefix := fmt.Sprintf("%d:", channelId)
+	states := make(map[string]*RateLimitState)
+	rateLimitStatesLock.RLock()
+	defer rateLimitStatesLock.RUnlock()
+	for key, state := range rateLimitStates {
+		if strings.HasPrefix(key, prefix) {
+			stateCopy := *state
+			states[strings.TrimPrefix(key, prefix)] = &stateCopy
+		}
+	}
+	return states
+}
+
+// filterRateLimited drops the candidates which are cooling down or ran out of their upstream quota for the model
+func filterRateLimited(candidates []*channelCandidate, model string) []*channelCandidate {
+	now := time.Now()
+	limited := make([]bool, len(candidates))
+	rateLimitStatesLock.RLock()
+	for i, candidate := range candidates {
+		state, ok := rateLimitStates[rateLimitKey(candidate.channel.Id, model)]
+		limited[i] = ok && state.exhausted(now)
+	}
+	rateLimitStatesLock.RUnlock()
+	if common.RedisEnabled && len(candidates) != 0 {
+		// cooldowns set by the other instances
+		keys := make([]string, 0, len(candidates))
+		for _, candidate := range candidates {
+			keys = append(keys, cooldownKey(candidate.channel.Id, model))
+		}
+		values, err := common.RDB.MGet(context.Background(), keys...).Result()
+		if err != nil {
+			logger.SysError("Redis get channel cooldowns error: " + err.Error())
+		} else {
+			for i, value := range values {
+				if value != nil {
+					limited[i] = true
+				}
+			}
+		}
+	}
+	filtered := make([]*channelCandidate, 0, len(candidates))
+	for i, candidate := range candidates {
+		if !limited[i] {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"github.com/eloxt/llmhub/common"
+	"testing"
+	"time"
+)
+
+func TestFilterRateLimited(t *testing.T) {
+	common.RedisEnabled = false
+	now := time.Now()
+	newCandidate := func(id int) *channelCandidate {
+		return &channelCandidate{channel: &Channel{Id: id}}
+	}
+	cooling, requestsOut, tokensOut, reset, free := newCandidate(-321), newCandidate(-322), newCandidate(-323), newCandidate(-324), newCandidate(-325)
+	SetChannelCooldown(cooling.channel.Id, "gpt-4o", now.Add(time.Minute))
+	RecordChannelRateLimit(requestsOut.channel.Id, "gpt-4o", 0, now.Add(time.Minute), 100, now.Add(time.Minute))
+	RecordChannelRateLimit(tokensOut.channel.Id, "gpt-4o", 10, now.Add(time.Minute), 0, now.Add(time.Minute))
+	RecordChannelRateLimit(reset.channel.Id, "gpt-4o", 0, now.Add(-time.Second), 0, now.Add(-time.Second))
+
+	candidates := []*channelCandidate{cooling, requestsOut, tokensOut, reset, free}
+	filtered := filterRateLimited(candidates, "gpt-4o")
+	if len(filtered) != 2 || filtered[0] != reset || filtered[1] != free {
+		ids := make([]int, 0, len(filtered))
+		for _, candidate := range filtered {
+			ids = append(ids, candidate.channel.Id)
+		}
+		t.Errorf("filtered channels = %v, want the reset and the free ones", ids)
+	}
+	// the cooldown is for the model only
+	if filtered := filterRateLimited(candidates, "gpt-4o-mini"); len(filtered) != len(candidates) {
+		t.Errorf("%d channels left for another model, want all of them", len(filtered))
+	}
+
+	// a shorter cooldown never cuts one short
+	SetChannelCooldown(cooling.channel.Id, "gpt-4o", now.Add(time.Second))
+	if until := GetChannelRateLimits(cooling.channel.Id)["gpt-4o"].CooldownUntil; !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("cooldown until %s, want the longer one", until)
+	}
+}
@@ -21,15 +21,26 @@ type Log struct {
 	Username          string    `json:"username" gorm:"index:index_username_model_name,priority:2;default:''"`
 	TokenName         string    `json:"token_name" gorm:"index;default:''"`
 	ModelName         string    `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
+	ModelAlias        string    `json:"model_alias" gorm:"index;default:''"`
 	Quota             float64   `json:"quota" gorm:"default:0"`
 	PromptTokens      int       `json:"prompt_tokens" gorm:"default:0"`
 	CompletionTokens  int       `json:"completion_tokens" gorm:"default:0"`
-	CachedTokens      int       `json:"cached_tokens" gorm:"default:0"`
+	CachedTokens      int       `json:"cached_tokens" gorm:"default:0"`      // read from the prompt cache
+	CacheWriteTokens  int       `json:"cache_write_tokens" gorm:"default:0"` // written to the prompt cache
+	UncachedTokens    int       `json:"uncached_tokens" gorm:"default:0"`
+	ReasoningTokens   int       `json:"reasoning_tokens" gorm:"default:0"` // part of the completion tokens
 	ChannelId         int       `json:"channel" gorm:"index"`
 	RequestId         string    `json:"request_id" gorm:"default:''"`
 	ElapsedTime       int64     `json:"elapsed_time" gorm:"default:0"` // unit is ms
 	IsStream          bool      `json:"is_stream" gorm:"default:false"`
 	SystemPromptReset bool      `json:"system_prompt_reset" gorm:"default:false"`
+	Hedged            bool      `json:"hedged" gorm:"default:false"`
+	HedgeWon          bool      `json:"hedge_won" gorm:"default:false"`
+	KeyGeneration     int       `json:"key_generation" gorm:"default:0"` // 0 means unknown
+	ParamRules        string    `json:"param_rules" gorm:"default:''"`   // the parameter policy rules which fired
+	PricingTier       string    `json:"pricing_tier" gorm:"default:''"`  // empty means the flat prices
+	// Tags are stored in LogTag
+	Tags map[string]string `json:"tags,omitempty" gorm:"-:all"`
 }
 
 const (
@@ -49,6 +60,10 @@ func recordLogHelper(ctx context.Context, log *Log) {
 		logger.Error(ctx, "failed to record log: "+err.Error())
 		return
 	}
+	err = recordLogTags(log)
+	if err != nil {
+		logger.Error(ctx, "failed to record log tags: "+err.Error())
+	}
 	logger.Infof(ctx, "record log: %+v", log)
 }
 
@@ -82,42 +97,6 @@ func RecordTestLog(ctx context.Context, log *Log) {
 	recordLogHelper(ctx, log)
 }
 
-func GetAllLogs(logType int, startTimestamp int64, endTimestamp int64, modelName string, username string, tokenName string, startIdx int, num int, channel int) (logs []*Log, total int64, err error) {
-	var tx *gorm.DB
-	if logType == LogTypeUnknown {
-		tx = LOG_DB
-	} else {
-		tx = LOG_DB.Where("type = ?", logType)
-	}
-	if modelName != "" {
-		tx = tx.Where("model_name = ?", modelName)
-	}
-	if username != "" {
-		tx = tx.Where("username = ?", username)
-	}
-	if tokenName != "" {
-		tx = tx.Where("token_name = ?", tokenName)
-	}
-	if startTimestamp != 0 {
-		tx = tx.Where("created_at >= ?", startTimestamp)
-	}
-	if endTimestamp != 0 {
-		tx = tx.Where("created_at <= ?", endTimestamp)
-	}
-	if channel != 0 {
-		tx = tx.Where("channel_id = ?", channel)
-	}
-	err = tx.Model(&Log{}).Count(&total).Error
-	if err != nil {
-		return nil, 0, err
-	}
-	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&logs).Error
-	if err != nil {
-		return nil, 0, err
-	}
-	return logs, total, err
-}
-
 func GetUserLogs(userId int, logType int, startTimestamp int64, endTimestamp int64, modelName string, tokenName string, startIdx int, num int) (logs []*Log, err error) {
 	var tx *gorm.DB
 	if logType == LogTypeUnknown {
@@ -132,10 +111,10 @@ func GetUserLogs(userId int, logType int, startTimestamp int64, endTimestamp int
 		tx = tx.Where("token_name = ?", tokenName)
 	}
 	if startTimestamp != 0 {
-		tx = tx.Where("created_at >= ?", startTimestamp)
+		tx = tx.Where("created_at >= ?", time.Unix(startTimestamp, 0))
 	}
 	if endTimestamp != 0 {
-		tx = tx.Where("created_at <= ?", endTimestamp)
+		tx = tx.Where("created_at <= ?", time.Unix(endTimestamp, 0))
 	}
 	err = tx.Order("id desc").Limit(num).Offset(startIdx).Omit("id").Find(&logs).Error
 	return logs, err
@@ -164,10 +143,10 @@ func SumUsedQuota(logType int, startTimestamp int64, endTimestamp int64, modelNa
 		tx = tx.Where("token_name = ?", tokenName)
 	}
 	if startTimestamp != 0 {
-		tx = tx.Where("created_at >= ?", startTimestamp)
+		tx = tx.Where("created_at >= ?", time.Unix(startTimestamp, 0))
 	}
 	if endTimestamp != 0 {
-		tx = tx.Where("created_at <= ?", endTimestamp)
+		tx = tx.Where("created_at <= ?", time.Unix(endTimestamp, 0))
 	}
 	if modelName != "" {
 		tx = tx.Where("model_name = ?", modelName)
@@ -192,10 +171,10 @@ func SumUsedToken(logType int, startTimestamp int64, endTimestamp int64, modelNa
 		tx = tx.Where("token_name = ?", tokenName)
 	}
 	if startTimestamp != 0 {
-		tx = tx.Where("created_at >= ?", startTimestamp)
+		tx = tx.Where("created_at >= ?", time.Unix(startTimestamp, 0))
 	}
 	if endTimestamp != 0 {
-		tx = tx.Where("created_at <= ?", endTimestamp)
+		tx = tx.Where("created_at <= ?", time.Unix(endTimestamp, 0))
 	}
 	if modelName != "" {
 		tx = tx.Where("model_name = ?", modelName)
@@ -204,8 +183,14 @@ func SumUsedToken(logType int, startTimestamp int64, endTimestamp int64, modelNa
 	return token
 }
 
+// DeleteOldLog deletes the logs created before the unix timestamp, with their tags
 func DeleteOldLog(targetTimestamp int64) (int64, error) {
-	result := LOG_DB.Where("created_at < ?", targetTimestamp).Delete(&Log{})
+	targetTime := time.Unix(targetTimestamp, 0)
+	err := LOG_DB.Where("log_id in (?)", LOG_DB.Model(&Log{}).Select("id").Where("created_at < ?", targetTime)).Delete(&LogTag{}).Error
+	if err != nil {
+		return 0, err
+	}
+	result := LOG_DB.Where("created_at < ?", targetTime).Delete(&Log{})
 	return result.RowsAffected, result.Error
 }
 
@@ -0,0 +1,197 @@
+package model
+
+import (
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const maxTagCount = 16
+
+var tagKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,64}$`)
+
+// LogTag is a cost attribution tag of a consume log, kept in its own table so the logs can be filtered and grouped by any tag
+type LogTag struct {
+	Id       int    `json:"id"`
+	LogId    int    `json:"log_id" gorm:"index"`
+	TagKey   string `json:"tag_key" gorm:"type:varchar(64);index:idx_tag_key_value,priority:1"`
+	TagValue string `json:"tag_value" gorm:"type:varchar(128);index:idx_tag_key_value,priority:2"`
+}
+
+// ParseTags parses tags like "project=search, env=prod"
+func ParseTags(tags string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range splitCommaList(tags) {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !ok || !tagKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("无效的标签：%s", pair)
+		}
+		if len(value) > 128 {
+			return nil, fmt.Errorf("标签 %s 的值过长", key)
+		}
+		result[key] = value
+	}
+	if len(result) > maxTagCount {
+		return nil, fmt.Errorf("标签数量不能超过 %d 个", maxTagCount)
+	}
+	return result, nil
+}
+
+// FormatTags is the reverse of ParseTags, the keys are sorted
+func FormatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// MergeTags returns the default tags of the token overridden by the tags of the request
+func MergeTags(defaults map[string]string, tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(defaults)+len(tags))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	return merged
+}
+
+func recordLogTags(log *Log) error {
+	if len(log.Tags) == 0 {
+		return nil
+	}
+	logTags := make([]LogTag, 0, len(log.Tags))
+	for key, value := range log.Tags {
+		logTags = append(logTags, LogTag{LogId: log.Id, TagKey: key, TagValue: value})
+	}
+	return LOG_DB.Create(&logTags).Error
+}
+
+// LogFilter is the conditions shared by the log query, statistic and export
+type LogFilter struct {
+	Type           int
+	StartTimestamp int64
+	EndTimestamp   int64
+	ModelName      string
+	Username       string
+	TokenName      string
+	Channel        int
+	Tags           map[string]string
+}
+
+func (filter *LogFilter) apply(tx *gorm.DB, table string) *gorm.DB {
+	column := func(name string) string {
+		if table == "" {
+			return name
+		}
+		return table + "." + name
+	}
+	if filter.Type != LogTypeUnknown {
+		tx = tx.Where(column("type")+" = ?", filter.Type)
+	}
+	if filter.ModelName != "" {
+		tx = tx.Where(column("model_name")+" = ?", filter.ModelName)
+	}
+	if filter.Username != "" {
+		tx = tx.Where(column("username")+" = ?", filter.Username)
+	}
+	if filter.TokenName != "" {
+		tx = tx.Where(column("token_name")+" = ?", filter.TokenName)
+	}
+	if filter.StartTimestamp != 0 {
+		tx = tx.Where(column("created_at")+" >= ?", time.Unix(filter.StartTimestamp, 0))
+	}
+	if filter.EndTimestamp != 0 {
+		tx = tx.Where(column("created_at")+" <= ?", time.Unix(filter.EndTimestamp, 0))
+	}
+	if filter.Channel != 0 {
+		tx = tx.Where(column("channel_id")+" = ?", filter.Channel)
+	}
+	for key, value := range filter.Tags {
+		tx = tx.Where(column("id")+" in (?)", LOG_DB.Model(&LogTag{}).Select("log_id").Where("tag_key = ? and tag_value = ?", key, value))
+	}
+	return tx
+}
+
+// GetFilteredLogs returns the logs matching the filter with their tags
+func GetFilteredLogs(filter *LogFilter, startIdx int, num int) (logs []*Log, total int64, err error) {
+	tx := filter.apply(LOG_DB.Model(&Log{}), "")
+	err = tx.Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	query := tx.Order("id desc").Offset(startIdx)
+	if num > 0 {
+		query = query.Limit(num)
+	}
+	err = query.Find(&logs).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return logs, total, fillLogTags(logs)
+}
+
+func fillLogTags(logs []*Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	id2Log := make(map[int]*Log, len(logs))
+	ids := make([]int, 0, len(logs))
+	for _, log := range logs {
+		id2Log[log.Id] = log
+		ids = append(ids, log.Id)
+	}
+	// keep the number of the parameters of a query within the limits of the databases
+	logTags := make([]*LogTag, 0)
+	for start := 0; start < len(ids); start += 1000 {
+		var chunk []*LogTag
+		err := LOG_DB.Where("log_id in ?", ids[start:min(start+1000, len(ids))]).Find(&chunk).Error
+		if err != nil {
+			return err
+		}
+		logTags = append(logTags, chunk...)
+	}
+	for _, logTag := range logTags {
+		log := id2Log[logTag.LogId]
+		if log.Tags == nil {
+			log.Tags = make(map[string]string)
+		}
+		log.Tags[logTag.TagKey] = logTag.TagValue
+	}
+	return nil
+}
+
+type TagStatistic struct {
+	TagValue         string  `json:"tag_value" gorm:"column:tag_value"`
+	RequestCount     int     `json:"request_count" gorm:"column:request_count"`
+	Quota            float64 `json:"quota" gorm:"column:quota"`
+	PromptTokens     int     `json:"prompt_tokens" gorm:"column:prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens" gorm:"column:completion_tokens"`
+}
+
+// GetTagStatistics sums the consume logs matching the filter by the values of the tag, the logs without it are under ""
+func GetTagStatistics(filter *LogFilter, tagKey string) (statistics []*TagStatistic, err error) {
+	ifnull := "ifnull"
+	if common.UsingPostgreSQL {
+		ifnull = "COALESCE"
+	}
+	consumeFilter := *filter
+	consumeFilter.Type = LogTypeConsume
+	tx := LOG_DB.Table("logs").
+		Select(fmt.Sprintf("%s(log_tags.tag_value, '') as tag_value, count(1) as request_count, "+
+			"sum(logs.quota) as quota, sum(logs.prompt_tokens) as prompt_tokens, sum(logs.completion_tokens) as completion_tokens", ifnull)).
+		Joins("left join log_tags on log_tags.log_id = logs.id and log_tags.tag_key = ?", tagKey)
+	tx = consumeFilter.apply(tx, "logs")
+	err = tx.Group(fmt.Sprintf("%s(log_tags.tag_value, '')", ifnull)).Order("quota desc").Scan(&statistics).Error
+	return statistics, err
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tooMany := make([]string, 0, maxTagCount+1)
+	for i := 0; i <= maxTagCount; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("k%d=v", i))
+	}
+	tests := []struct {
+		name    string
+		tags    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"single", "project=search", map[string]string{"project": "search"}, false},
+		{"spaces", " project = search , env=prod ", map[string]string{"project": "search", "env": "prod"}, false},
+		{"empty value", "env=", map[string]string{"env": ""}, false},
+		{"value with equal sign", "q=a=b", map[string]string{"q": "a=b"}, false},
+		{"last one wins", "env=dev,env=prod", map[string]string{"env": "prod"}, false},
+		{"missing equal sign", "project", nil, true},
+		{"empty key", "=search", nil, true},
+		{"invalid key", "pro ject=search", nil, true},
+		{"value too long", "env=" + strings.Repeat("a", 129), nil, true},
+		{"too many", strings.Join(tooMany, ","), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTags(tt.tags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTags(%q) = %v, want %v", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
@@ -47,7 +47,6 @@ func CreateRootAccountIfNeed() error {
 			token := Token{
 				Id:             1,
 				UserId:         rootUser.Id,
-				Key:            config.InitialRootToken,
 				Status:         TokenStatusEnabled,
 				Name:           "Initial Root Token",
 				CreatedTime:    time.Now(),
@@ -55,6 +54,7 @@ func CreateRootAccountIfNeed() error {
 				RemainQuota:    1,
 				UnlimitedQuota: true,
 			}
+			token.SetKey(strings.TrimPrefix(config.InitialRootToken, "sk-"))
 			DB.Create(&token)
 		}
 	}
@@ -116,6 +116,7 @@ func InitDB() {
 	sqlDB := setDBConns(DB)
 
 	if !config.IsMasterNode {
+		initTokenKeySecret()
 		return
 	}
 
@@ -129,6 +130,10 @@ func InitDB() {
 		return
 	}
 	logger.SysLog("database migrated")
+	initTokenKeySecret()
+	if err = migrateTokenKeys(); err != nil {
+		logger.FatalLog("failed to migrate token keys: " + err.Error())
+	}
 }
 
 func migrateDB() error {
@@ -151,6 +156,21 @@ func migrateDB() error {
 	if err = DB.AutoMigrate(&Channel{}); err != nil {
 		return err
 	}
+	if err = DB.AutoMigrate(&Alias{}); err != nil {
+		return err
+	}
+	if err = DB.AutoMigrate(&Shadow{}); err != nil {
+		return err
+	}
+	if err = DB.AutoMigrate(&ShadowLog{}); err != nil {
+		return err
+	}
+	if err = DB.AutoMigrate(&LogTag{}); err != nil {
+		return err
+	}
+	if err = DB.AutoMigrate(&PriceChange{}); err != nil {
+		return err
+	}
 	return nil
 }
 
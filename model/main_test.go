@@ -0,0 +1,61 @@
+package model
+
+import (
+	"github.com/eloxt/llmhub/common"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB points DB and LOG_DB at a fresh in-memory SQLite database, Redis is disabled
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	common.RedisEnabled = false
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single connection, every new one would be another empty database
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	DB = db
+	LOG_DB = db
+	err = migrateDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sqlDB.Close()
+	})
+}
+
+func createTestToken(t *testing.T, token *Token) *Token {
+	t.Helper()
+	if token.Status == 0 {
+		token.Status = TokenStatusEnabled
+	}
+	if token.Key == "" {
+		token.GenerateKey()
+	}
+	err := DB.Create(token).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func getTestToken(t *testing.T, id int) *Token {
+	t.Helper()
+	token, err := GetTokenById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
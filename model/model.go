@@ -5,17 +5,23 @@ import (
 	"github.com/eloxt/llmhub/common"
 	"github.com/eloxt/llmhub/common/logger"
 	"gorm.io/gorm"
+	"slices"
 	"sort"
 )
 
 type Model struct {
-	Id         int     `json:"id" gorm:"primary_key"`
-	Name       string  `json:"name" gorm:"type:text"`
-	MappedName string  `json:"mapped_name"`
-	ChannelId  int     `json:"channel_id"`
-	Enabled    bool    `json:"enabled"`
-	Priority   *int64  `json:"priority" gorm:"bigint;default:0;index"`
-	Config     *Config `json:"config" gorm:"serializer:json"`
+	Id         int    `json:"id" gorm:"primary_key"`
+	Name       string `json:"name" gorm:"type:text"`
+	MappedName string `json:"mapped_name"`
+	ChannelId  int    `json:"channel_id"`
+	Enabled    bool   `json:"enabled"`
+	Priority   *int64 `json:"priority" gorm:"bigint;default:0;index"`
+	// Weight is the share of the traffic among the rows of the same priority, relative to the others
+	Weight *int    `json:"weight" gorm:"default:100"`
+	Ramp   *Ramp   `json:"ramp,omitempty" gorm:"serializer:json"`
+	Config *Config `json:"config" gorm:"serializer:json"`
+	// UpstreamMissing is set by the price sync when the upstream no longer lists the model
+	UpstreamMissing bool `json:"upstream_missing" gorm:"default:false"`
 }
 
 type Config struct {
@@ -24,38 +30,114 @@ type Config struct {
 	Completion      float64 `json:"completion"`
 	InputCacheRead  float64 `json:"input_cache_read"`
 	InputCacheWrite float64 `json:"input_cache_write,omitempty"`
-	Reasoning       float64 `json:"reasoning,omitempty"`
+	Reasoning       float64 `json:"reasoning,omitempty"` // 0 means the reasoning tokens are billed as completion tokens
 	Additional      float64 `json:"additional,omitempty"`
 	Tokenizer       string  `json:"tokenizer,omitempty"`
+	// Capabilities lists the optional features the upstream supports for this model,
+	// an empty list means unknown and the row is not excluded from any request
+	Capabilities []string `json:"capabilities,omitempty"`
+	// HedgeDelay is the time in milliseconds to wait for the first byte before sending
+	// the request to a second channel, 0 means hedging is disabled
+	HedgeDelay int `json:"hedge_delay,omitempty"`
+	// Tiers are ordered by their prompt threshold, the last one matching a request replaces the prices above
+	Tiers []PriceTier `json:"tiers,omitempty"`
 }
 
-func GetRandomSatisfiedChannel(model string, ignoreFirstPriority bool) (*Channel, error) {
-	ability := Model{}
+// GetReasoningPrice returns the price of the reasoning tokens, which falls back to the completion price
+func (c Config) GetReasoningPrice() float64 {
+	if c.Reasoning > 0 {
+		return c.Reasoning
+	}
+	return c.Completion
+}
+
+// GetCacheWritePrice returns the price of the tokens written to the prompt cache, which falls back to the prompt price
+func (c Config) GetCacheWritePrice() float64 {
+	if c.InputCacheWrite > 0 {
+		return c.InputCacheWrite
+	}
+	return c.Prompt
+}
+
+const (
+	CapabilityTools      = "tools"
+	CapabilityVision     = "vision"
+	CapabilityJSONSchema = "json_schema"
+	CapabilityAudio      = "audio"
+	CapabilityReasoning  = "reasoning"
+)
+
+// Supports reports whether the model row can serve a request using all the required features.
+func (cfg *Config) Supports(required []string) bool {
+	if len(required) == 0 || cfg == nil || len(cfg.Capabilities) == 0 {
+		return true
+	}
+	for _, capability := range required {
+		if !slices.Contains(cfg.Capabilities, capability) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetRandomSatisfiedChannel(group string, model string, ignoreFirstPriority bool, capabilities []string) (*Channel, error) {
 	trueVal := "1"
 	if common.UsingPostgreSQL {
 		trueVal = "true"
 	}
 
-	var err error = nil
-	var channelQuery *gorm.DB
-	if ignoreFirstPriority {
-		channelQuery = DB.Where("name = ? and enabled = "+trueVal, model)
-	} else {
-		maxPrioritySubQuery := DB.Model(&Model{}).Select("MAX(priority)").Where("name = ? and enabled = "+trueVal, model)
-		channelQuery = DB.Where(" name = ? and enabled = "+trueVal+" and priority = (?)", model, maxPrioritySubQuery)
+	var abilities []*Model
+	err := DB.Where("name = ? and enabled = "+trueVal, model).Order("priority DESC").Find(&abilities).Error
+	if err != nil {
+		return nil, err
 	}
-	if common.UsingSQLite || common.UsingPostgreSQL {
-		err = channelQuery.Order("RANDOM()").First(&ability).Error
-	} else {
-		err = channelQuery.Order("RAND()").First(&ability).Error
+	channelIds := make([]int, 0, len(abilities))
+	for _, ability := range abilities {
+		channelIds = append(channelIds, ability.ChannelId)
 	}
+	var channels []*Channel
+	err = DB.Where("id in ?", channelIds).Find(&channels).Error
 	if err != nil {
 		return nil, err
 	}
-	channel := Channel{}
-	channel.Id = ability.ChannelId
-	err = DB.First(&channel, "id = ?", ability.ChannelId).Error
-	return &channel, err
+	id2Channel := make(map[int]*Channel)
+	for _, channel := range channels {
+		id2Channel[channel.Id] = channel
+	}
+	candidates := make([]*channelCandidate, 0, len(abilities))
+	for _, ability := range abilities {
+		channel, ok := id2Channel[ability.ChannelId]
+		if !ok || !channel.HasGroup(group) {
+			continue
+		}
+		candidates = append(candidates, &channelCandidate{
+			channel:  channel,
+			model:    ability,
+			priority: ability.GetPriority(),
+		})
+	}
+	candidates = filterCandidates(candidates, model, capabilities)
+	if len(candidates) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if ignoreFirstPriority {
+		return pickWeighted(candidates).channel, nil
+	}
+	return pickCandidate(candidates, false).channel, nil
+}
+
+func (m *Model) GetWeight() int {
+	if m.Weight == nil {
+		return 100
+	}
+	return *m.Weight
+}
+
+func (m *Model) GetPriority() int64 {
+	if m.Priority == nil {
+		return 0
+	}
+	return *m.Priority
 }
 
 func (channel *Channel) AddModels() error {
@@ -64,6 +146,7 @@ func (channel *Channel) AddModels() error {
 		return nil
 	}
 	for _, _model := range models {
+		_model.ChannelId = channel.Id
 		_model.Enabled = channel.Status == ChannelStatusEnabled
 	}
 	return DB.Create(models).Error
@@ -75,34 +158,98 @@ func (channel *Channel) DeleteModels() error {
 
 // UpdateModels updates abilities of this channel.
 // Make sure the channel is completed before calling this function.
+// The rows are matched by name, a matched row keeps its id, its upstream missing flag,
+// and its weight and ramp unless new ones are given; a ramp with the same schedule keeps its progress.
 func (channel *Channel) UpdateModels() error {
-	// A quick and dirty way to update abilities
-	// First delete all abilities of this channel
-	err := channel.DeleteModels()
+	var oldModels []*Model
+	err := DB.Where("channel_id = ?", channel.Id).Order("id").Find(&oldModels).Error
 	if err != nil {
 		return err
 	}
-	// Then add new abilities
-	err = channel.AddModels()
-	if err != nil {
-		return err
+	name2Models := make(map[string][]*Model)
+	for _, m := range oldModels {
+		name2Models[m.Name] = append(name2Models[m.Name], m)
+	}
+	var newModels []*Model
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for _, m := range channel.Models {
+			m.ChannelId = channel.Id
+			m.Enabled = channel.Status == ChannelStatusEnabled
+			matched := name2Models[m.Name]
+			if len(matched) == 0 {
+				m.Id = 0
+				newModels = append(newModels, m)
+				continue
+			}
+			old := matched[0]
+			name2Models[m.Name] = matched[1:]
+			m.keepState(old)
+			err := tx.Model(m).Select("mapped_name", "enabled", "priority", "weight", "ramp", "config").Updates(m).Error
+			if err != nil {
+				return err
+			}
+		}
+		var removedIds []int
+		for _, models := range name2Models {
+			for _, m := range models {
+				removedIds = append(removedIds, m.Id)
+			}
+		}
+		if len(removedIds) > 0 {
+			err := tx.Delete(&Model{}, removedIds).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(newModels) > 0 {
+			return tx.Create(newModels).Error
+		}
+		return nil
+	})
+}
+
+// keepState copies the state of the stored row which an edit of the channel must not reset
+func (m *Model) keepState(old *Model) {
+	m.Id = old.Id
+	m.UpstreamMissing = old.UpstreamMissing
+	if m.Ramp == nil {
+		m.Ramp = old.Ramp
+	} else if old.Ramp != nil && m.Ramp.sameSchedule(old.Ramp) {
+		// the weight belongs to the ramp while it runs
+		m.Ramp = old.Ramp
+		m.Weight = old.Weight
+	}
+	if m.Weight == nil {
+		m.Weight = old.Weight
 	}
-	return nil
 }
 
 func UpdateModelStatus(channelId int, status bool) error {
 	return DB.Model(&Model{}).Where("channel_id = ?", channelId).Select("enabled").Update("enabled", status).Error
 }
 
+// GetGroupModels returns the public names of the models reachable by the group
 func GetGroupModels(ctx context.Context, group string) ([]string, error) {
-	groupCol := "`group`"
 	trueVal := "1"
 	if common.UsingPostgreSQL {
-		groupCol = `"group"`
 		trueVal = "true"
 	}
+	var channels []*Channel
+	err := DB.Select("id", "groups").Where("status = ?", ChannelStatusEnabled).Find(&channels).Error
+	if err != nil {
+		return nil, err
+	}
+	channelIds := make([]int, 0, len(channels))
+	for _, channel := range channels {
+		if channel.HasGroup(group) {
+			channelIds = append(channelIds, channel.Id)
+		}
+	}
+	if len(channelIds) == 0 {
+		return nil, nil
+	}
 	var models []string
-	err := DB.Model(&Model{}).Distinct("name").Where(groupCol+" = ? and enabled = "+trueVal, group).Pluck("model", &models).Error
+	err = DB.Model(&Model{}).Distinct("mapped_name").Where("channel_id in ? and enabled = "+trueVal, channelIds).Pluck("mapped_name", &models).Error
 	if err != nil {
 		return nil, err
 	}
@@ -170,3 +317,26 @@ func GetModelDetailList() ([]*Model, error) {
 	}
 	return models, err
 }
+
+// GetModelCapabilities returns the union of the declared capabilities of every enabled row, keyed by mapped name.
+func GetModelCapabilities() (map[string][]string, error) {
+	models, err := GetModelList()
+	if err != nil {
+		return nil, err
+	}
+	capabilities := make(map[string][]string)
+	for _, m := range models {
+		if m.Config == nil {
+			continue
+		}
+		for _, capability := range m.Config.Capabilities {
+			if !slices.Contains(capabilities[m.MappedName], capability) {
+				capabilities[m.MappedName] = append(capabilities[m.MappedName], capability)
+			}
+		}
+	}
+	for name := range capabilities {
+		sort.Strings(capabilities[name])
+	}
+	return capabilities, nil
+}
@@ -0,0 +1,182 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	relaymodel "github.com/eloxt/llmhub/relay/model"
+	"math"
+	"reflect"
+	"strings"
+)
+
+const (
+	ParamActionClamp    = "clamp"    // keeps a number within min and max
+	ParamActionDefault  = "default"  // sets the value when the field is missing
+	ParamActionOverride = "override" // always sets the value
+	ParamActionRemove   = "remove"   // drops the field
+	ParamActionReject   = "reject"   // fails the request when the field is set, or out of min and max when any of them is given
+)
+
+// ParamRule acts on a field of the request, named as in the JSON of the OpenAI API
+type ParamRule struct {
+	Field  string   `json:"field"`
+	Action string   `json:"action"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Value  any      `json:"value,omitempty"`
+}
+
+// ParamPolicy is a list of rules applied to the requests of a token or a channel, in order
+type ParamPolicy []ParamRule
+
+func (rule *ParamRule) String() string {
+	return rule.Field + ":" + rule.Action
+}
+
+// requestFieldTypes maps the JSON names of the fields of a request to their types,
+// the request goes through GeneralOpenAIRequest so no other field can be acted on
+var requestFieldTypes = func() map[string]reflect.Type {
+	fieldTypes := make(map[string]reflect.Type)
+	requestType := reflect.TypeOf(relaymodel.GeneralOpenAIRequest{})
+	for i := 0; i < requestType.NumField(); i++ {
+		field := requestType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fieldTypes[name] = field.Type
+		}
+	}
+	return fieldTypes
+}()
+
+// validateType checks the bounds and the value of the rule against the type of its field
+func (rule *ParamRule) validateType(fieldType reflect.Type) error {
+	if fieldType.Kind() == reflect.Pointer {
+		fieldType = fieldType.Elem()
+	}
+	var isInt, isNumber bool
+	switch fieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		isInt, isNumber = true, true
+	case reflect.Float32, reflect.Float64:
+		isNumber = true
+	}
+	if rule.Min != nil || rule.Max != nil {
+		if !isNumber {
+			return fmt.Errorf("参数 %s 不是数字，参数规则 %s 不能设置 min 或 max", rule.Field, rule.String())
+		}
+		for _, bound := range []*float64{rule.Min, rule.Max} {
+			if bound != nil && isInt && *bound != math.Trunc(*bound) {
+				return fmt.Errorf("参数 %s 是整数，参数规则 %s 的 min 和 max 也必须是整数", rule.Field, rule.String())
+			}
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return fmt.Errorf("参数规则 %s 的 min 不能大于 max", rule.String())
+		}
+	}
+	if rule.Value != nil {
+		// the value must fit the field, or the request fails to decode after the rule fired
+		jsonBytes, err := json.Marshal(rule.Value)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(jsonBytes, reflect.New(fieldType).Interface())
+		if err != nil {
+			return fmt.Errorf("参数规则 %s 的 value 类型与参数不符", rule.String())
+		}
+	}
+	return nil
+}
+
+func (p ParamPolicy) Validate() error {
+	for _, rule := range p {
+		if rule.Field == "" {
+			return fmt.Errorf("参数规则缺少字段名")
+		}
+		fieldType, ok := requestFieldTypes[rule.Field]
+		if !ok {
+			return fmt.Errorf("未知的参数：%s", rule.Field)
+		}
+		switch rule.Action {
+		case ParamActionClamp:
+			if rule.Min == nil && rule.Max == nil {
+				return fmt.Errorf("参数规则 %s 需要 min 或 max", rule.String())
+			}
+		case ParamActionDefault, ParamActionOverride:
+			if rule.Value == nil {
+				return fmt.Errorf("参数规则 %s 需要 value", rule.String())
+			}
+		case ParamActionRemove, ParamActionReject:
+		default:
+			return fmt.Errorf("无效的参数规则动作：%s", rule.Action)
+		}
+		err := rule.validateType(fieldType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Apply changes the request in place and returns the rules which fired, an error when a reject rule fired
+func (p ParamPolicy) Apply(request map[string]any) ([]string, error) {
+	fired := make([]string, 0)
+	for _, rule := range p {
+		value, ok := request[rule.Field]
+		switch rule.Action {
+		case ParamActionClamp:
+			number, isNumber := toFloat(value)
+			if !ok || !isNumber {
+				continue
+			}
+			clamped := number
+			if rule.Min != nil {
+				clamped = max(clamped, *rule.Min)
+			}
+			if rule.Max != nil {
+				clamped = min(clamped, *rule.Max)
+			}
+			if clamped != number {
+				request[rule.Field] = clamped
+				fired = append(fired, rule.String())
+			}
+		case ParamActionDefault:
+			if !ok {
+				request[rule.Field] = rule.Value
+				fired = append(fired, rule.String())
+			}
+		case ParamActionOverride:
+			if !ok || !reflect.DeepEqual(value, rule.Value) {
+				request[rule.Field] = rule.Value
+				fired = append(fired, rule.String())
+			}
+		case ParamActionRemove:
+			if ok {
+				delete(request, rule.Field)
+				fired = append(fired, rule.String())
+			}
+		case ParamActionReject:
+			if !ok {
+				continue
+			}
+			if rule.Min != nil || rule.Max != nil {
+				number, isNumber := toFloat(value)
+				if isNumber && (rule.Min == nil || number >= *rule.Min) && (rule.Max == nil || number <= *rule.Max) {
+					continue
+				}
+			}
+			fired = append(fired, rule.String())
+			return fired, fmt.Errorf("参数 %s 不被允许", rule.Field)
+		}
+	}
+	return fired, nil
+}
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestParamPolicyApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    ParamPolicy
+		request   map[string]any
+		want      map[string]any
+		wantFired []string
+		wantErr   bool
+	}{
+		{
+			name:      "clamp above max",
+			policy:    ParamPolicy{{Field: "max_tokens", Action: ParamActionClamp, Max: floatPtr(1000)}},
+			request:   map[string]any{"max_tokens": float64(4096)},
+			want:      map[string]any{"max_tokens": float64(1000)},
+			wantFired: []string{"max_tokens:clamp"},
+		},
+		{
+			name:      "clamp within bounds",
+			policy:    ParamPolicy{{Field: "temperature", Action: ParamActionClamp, Min: floatPtr(0), Max: floatPtr(1)}},
+			request:   map[string]any{"temperature": 0.5},
+			want:      map[string]any{"temperature": 0.5},
+			wantFired: []string{},
+		},
+		{
+			name:      "clamp missing field",
+			policy:    ParamPolicy{{Field: "temperature", Action: ParamActionClamp, Max: floatPtr(1)}},
+			request:   map[string]any{},
+			want:      map[string]any{},
+			wantFired: []string{},
+		},
+		{
+			name:      "default when missing",
+			policy:    ParamPolicy{{Field: "max_tokens", Action: ParamActionDefault, Value: float64(512)}},
+			request:   map[string]any{},
+			want:      map[string]any{"max_tokens": float64(512)},
+			wantFired: []string{"max_tokens:default"},
+		},
+		{
+			name:      "default when set",
+			policy:    ParamPolicy{{Field: "max_tokens", Action: ParamActionDefault, Value: float64(512)}},
+			request:   map[string]any{"max_tokens": float64(100)},
+			want:      map[string]any{"max_tokens": float64(100)},
+			wantFired: []string{},
+		},
+		{
+			name:      "override",
+			policy:    ParamPolicy{{Field: "n", Action: ParamActionOverride, Value: float64(1)}},
+			request:   map[string]any{"n": float64(4)},
+			want:      map[string]any{"n": float64(1)},
+			wantFired: []string{"n:override"},
+		},
+		{
+			name:      "override with the same value",
+			policy:    ParamPolicy{{Field: "n", Action: ParamActionOverride, Value: float64(1)}},
+			request:   map[string]any{"n": float64(1)},
+			want:      map[string]any{"n": float64(1)},
+			wantFired: []string{},
+		},
+		{
+			name:      "remove",
+			policy:    ParamPolicy{{Field: "logit_bias", Action: ParamActionRemove}},
+			request:   map[string]any{"logit_bias": map[string]any{"1": float64(100)}},
+			want:      map[string]any{},
+			wantFired: []string{"logit_bias:remove"},
+		},
+		{
+			name:      "reject when set",
+			policy:    ParamPolicy{{Field: "tools", Action: ParamActionReject}},
+			request:   map[string]any{"tools": []any{}},
+			want:      map[string]any{"tools": []any{}},
+			wantFired: []string{"tools:reject"},
+			wantErr:   true,
+		},
+		{
+			name:      "reject out of bounds",
+			policy:    ParamPolicy{{Field: "n", Action: ParamActionReject, Max: floatPtr(2)}},
+			request:   map[string]any{"n": float64(3)},
+			want:      map[string]any{"n": float64(3)},
+			wantFired: []string{"n:reject"},
+			wantErr:   true,
+		},
+		{
+			name:      "reject within bounds",
+			policy:    ParamPolicy{{Field: "n", Action: ParamActionReject, Max: floatPtr(2)}},
+			request:   map[string]any{"n": float64(2)},
+			want:      map[string]any{"n": float64(2)},
+			wantFired: []string{},
+		},
+		{
+			name: "rules apply in order",
+			policy: ParamPolicy{
+				{Field: "max_tokens", Action: ParamActionDefault, Value: float64(8000)},
+				{Field: "max_tokens", Action: ParamActionClamp, Max: floatPtr(4000)},
+			},
+			request:   map[string]any{},
+			want:      map[string]any{"max_tokens": float64(4000)},
+			wantFired: []string{"max_tokens:default", "max_tokens:clamp"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fired, err := tt.policy.Apply(tt.request)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(fired, tt.wantFired) {
+				t.Errorf("fired = %v, want %v", fired, tt.wantFired)
+			}
+			if !reflect.DeepEqual(tt.request, tt.want) {
+				t.Errorf("request = %v, want %v", tt.request, tt.want)
+			}
+		})
+	}
+}
+
+func TestParamPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ParamRule
+		wantErr bool
+	}{
+		{"clamp a float", ParamRule{Field: "temperature", Action: ParamActionClamp, Max: floatPtr(1.5)}, false},
+		{"clamp an int", ParamRule{Field: "max_tokens", Action: ParamActionClamp, Max: floatPtr(1000)}, false},
+		{"clamp an int with a fraction", ParamRule{Field: "n", Action: ParamActionClamp, Max: floatPtr(2.5)}, true},
+		{"clamp without bounds", ParamRule{Field: "n", Action: ParamActionClamp}, true},
+		{"clamp a string", ParamRule{Field: "user", Action: ParamActionClamp, Max: floatPtr(1)}, true},
+		{"min above max", ParamRule{Field: "n", Action: ParamActionClamp, Min: floatPtr(3), Max: floatPtr(2)}, true},
+		{"override an int", ParamRule{Field: "max_tokens", Action: ParamActionOverride, Value: float64(100)}, false},
+		{"override an int with a string", ParamRule{Field: "max_tokens", Action: ParamActionOverride, Value: "abc"}, true},
+		{"override an int with a fraction", ParamRule{Field: "max_tokens", Action: ParamActionOverride, Value: 1.5}, true},
+		{"default without value", ParamRule{Field: "max_tokens", Action: ParamActionDefault}, true},
+		{"default any", ParamRule{Field: "stop", Action: ParamActionDefault, Value: []any{"\n"}}, false},
+		{"unknown field", ParamRule{Field: "foo", Action: ParamActionRemove}, true},
+		{"unknown action", ParamRule{Field: "n", Action: "drop"}, true},
+		{"missing field", ParamRule{Action: ParamActionRemove}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ParamPolicy{tt.rule}.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package model
+
+import (
+	"errors"
+	"github.com/eloxt/llmhub/common/logger"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	PriceChangeStatusPending  = "pending"
+	PriceChangeStatusApplied  = "applied"
+	PriceChangeStatusRejected = "rejected"
+)
+
+// PriceChange is a difference between the stored prices of a model row and the ones listed by the upstream.
+// It is applied at once by the sync when PRICE_SYNC_AUTO_APPLY is set, or waits for an approval otherwise,
+// the applied ones are kept as the price history.
+type PriceChange struct {
+	Id        int    `json:"id"`
+	ChannelId int    `json:"channel_id" gorm:"index"`
+	ModelName string `json:"model_name" gorm:"index"`
+	// a row removed from the channel and added again gets a new id, so they are found by the channel and the name
+	OldPrice    *Config    `json:"old_price" gorm:"type:text;serializer:json"`
+	NewPrice    *Config    `json:"new_price" gorm:"type:text;serializer:json"`
+	Status      string     `json:"status" gorm:"type:varchar(16);index;default:'pending'"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ResolvedAt  *time.Time `json:"resolved_at"`
+	AutoApplied bool       `json:"auto_applied" gorm:"default:false"`
+}
+
+// priceOf keeps only the prices of a config
+func priceOf(c *Config) *Config {
+	if c == nil {
+		return &Config{}
+	}
+	return &Config{
+		Prompt:          c.Prompt,
+		Completion:      c.Completion,
+		InputCacheRead:  c.InputCacheRead,
+		InputCacheWrite: c.InputCacheWrite,
+		Reasoning:       c.Reasoning,
+		Additional:      c.Additional,
+	}
+}
+
+// HasPrice reports whether any price is set, a model list without pricing has none
+func (c *Config) HasPrice() bool {
+	return !c.SamePrice(nil)
+}
+
+// SamePrice reports whether both configs have the same prices
+func (c *Config) SamePrice(other *Config) bool {
+	a, b := priceOf(c), priceOf(other)
+	return a.Prompt == b.Prompt && a.Completion == b.Completion &&
+		a.InputCacheRead == b.InputCacheRead && a.InputCacheWrite == b.InputCacheWrite &&
+		a.Reasoning == b.Reasoning && a.Additional == b.Additional
+}
+
+// withPrice returns a copy of the config with the prices of the other one
+func (c *Config) withPrice(price *Config) *Config {
+	config := Config{}
+	if c != nil {
+		config = *c
+	}
+	config.Prompt = price.Prompt
+	config.Completion = price.Completion
+	config.InputCacheRead = price.InputCacheRead
+	config.InputCacheWrite = price.InputCacheWrite
+	config.Reasoning = price.Reasoning
+	config.Additional = price.Additional
+	return &config
+}
+
+func GetPriceChanges(startIdx int, num int, channelId int, status string) (changes []*PriceChange, total int64, err error) {
+	tx := DB.Model(&PriceChange{})
+	if channelId != 0 {
+		tx = tx.Where("channel_id = ?", channelId)
+	}
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	err = tx.Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&changes).Error
+	return changes, total, err
+}
+
+func applyPriceChange(tx *gorm.DB, change *PriceChange) error {
+	var rows []*Model
+	err := tx.Where("channel_id = ? and name = ?", change.ChannelId, change.ModelName).Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return errors.New("模型已不存在")
+	}
+	for _, row := range rows {
+		err = tx.Model(&Model{Id: row.Id}).Select("config").Updates(&Model{Config: row.Config.withPrice(change.NewPrice)}).Error
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	change.Status = PriceChangeStatusApplied
+	change.ResolvedAt = &now
+	return tx.Model(change).Select("status", "resolved_at", "auto_applied").Updates(change).Error
+}
+
+func resolvePriceChange(id int, approve bool) (*PriceChange, error) {
+	var change PriceChange
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.First(&change, "id = ?", id).Error
+		if err != nil {
+			return err
+		}
+		if change.Status != PriceChangeStatusPending {
+			return errors.New("该价格变更已处理")
+		}
+		if approve {
+			return applyPriceChange(tx, &change)
+		}
+		now := time.Now()
+		change.Status = PriceChangeStatusRejected
+		change.ResolvedAt = &now
+		return tx.Model(&change).Select("status", "resolved_at").Updates(&change).Error
+	})
+	return &change, err
+}
+
+// ApprovePriceChange writes the new prices into the model rows, the billing has to be reloaded afterwards
+func ApprovePriceChange(id int) (*PriceChange, error) {
+	return resolvePriceChange(id, true)
+}
+
+func RejectPriceChange(id int) (*PriceChange, error) {
+	return resolvePriceChange(id, false)
+}
+
+// PriceSyncResult counts what a sync of the prices of a channel has done
+type PriceSyncResult struct {
+	ChannelId       int      `json:"channel_id"`
+	Applied         int      `json:"applied"`
+	Pending         int      `json:"pending"`
+	UpstreamMissing []string `json:"upstream_missing"`
+}
+
+// SyncModelPrices diffs the model rows of the channel against the list of the upstream. The rows which are
+// no longer listed are flagged, but left enabled. The price changes are applied when autoApply is set,
+// otherwise they are queued once for each new price, replacing the pending ones of older prices.
+func SyncModelPrices(channelId int, upstream []*Model, autoApply bool) (*PriceSyncResult, error) {
+	upstreamModels := make(map[string]*Model, len(upstream))
+	for _, m := range upstream {
+		upstreamModels[m.Name] = m
+	}
+	rows, err := GetModelByChannel(channelId)
+	if err != nil {
+		return nil, err
+	}
+	result := &PriceSyncResult{ChannelId: channelId}
+	// a change is applied to all the rows of the same name
+	synced := make(map[string]bool)
+	for _, row := range rows {
+		// the mapped name is the name of the model at the upstream
+		upstreamName := row.MappedName
+		if upstreamName == "" {
+			upstreamName = row.Name
+		}
+		upstreamModel, ok := upstreamModels[upstreamName]
+		if ok != !row.UpstreamMissing {
+			row.UpstreamMissing = !ok
+			err = DB.Model(&Model{Id: row.Id}).Select("upstream_missing").Updates(row).Error
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !ok {
+			result.UpstreamMissing = append(result.UpstreamMissing, row.Name)
+			continue
+		}
+		if synced[row.Name] || !upstreamModel.Config.HasPrice() || row.Config.SamePrice(upstreamModel.Config) {
+			continue
+		}
+		synced[row.Name] = true
+		change := &PriceChange{
+			ChannelId: channelId,
+			ModelName: row.Name,
+			OldPrice:  priceOf(row.Config),
+			NewPrice:  priceOf(upstreamModel.Config),
+			Status:    PriceChangeStatusPending,
+		}
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			var pending []*PriceChange
+			err := tx.Where("channel_id = ? and model_name = ? and status = ?", channelId, row.Name, PriceChangeStatusPending).Find(&pending).Error
+			if err != nil {
+				return err
+			}
+			for _, p := range pending {
+				if p.NewPrice.SamePrice(change.NewPrice) {
+					if autoApply {
+						p.AutoApplied = true
+						return applyPriceChange(tx, p)
+					}
+					change = nil
+					return nil
+				}
+			}
+			now := time.Now()
+			err = tx.Model(&PriceChange{}).Where("channel_id = ? and model_name = ? and status = ?", channelId, row.Name, PriceChangeStatusPending).
+				Updates(map[string]any{"status": PriceChangeStatusRejected, "resolved_at": &now}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Create(change).Error
+			if err != nil || !autoApply {
+				return err
+			}
+			change.AutoApplied = true
+			return applyPriceChange(tx, change)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if change == nil {
+			continue
+		}
+		if autoApply {
+			result.Applied++
+			logger.SysLogf("price of %s on channel #%d changed from %+v to %+v", row.Name, channelId, *change.OldPrice, *change.NewPrice)
+		} else {
+			result.Pending++
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func getTestModel(t *testing.T, channelId int, name string) *Model {
+	t.Helper()
+	var m Model
+	err := DB.Where("channel_id = ? and name = ?", channelId, name).First(&m).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func getPendingPriceChanges(t *testing.T, channelId int) []*PriceChange {
+	t.Helper()
+	changes, _, err := GetPriceChanges(0, 100, channelId, PriceChangeStatusPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestSyncModelPrices(t *testing.T) {
+	setupTestDB(t)
+	channel := &Channel{Name: "priced", Key: "sk-test", Status: ChannelStatusEnabled}
+	channel.Models = []*Model{
+		{Name: "gpt-4o", MappedName: "gpt-4o", Config: &Config{Prompt: 1, Completion: 2, ContextLength: 128000}},
+		{Name: "o1", MappedName: "o1", Config: &Config{Prompt: 3, Completion: 4}},
+		{Name: "retired", MappedName: "retired", Config: &Config{Prompt: 1, Completion: 1}},
+	}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := func(gpt4oPrompt float64) []*Model {
+		return []*Model{
+			{Name: "gpt-4o", Config: &Config{Prompt: gpt4oPrompt, Completion: 2}},
+			{Name: "o1", Config: &Config{Prompt: 3, Completion: 4}},
+			{Name: "new-model", Config: &Config{Prompt: 1, Completion: 1}},
+		}
+	}
+
+	result, err := SyncModelPrices(channel.Id, upstream(1.5), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pending != 1 || result.Applied != 0 || !reflect.DeepEqual(result.UpstreamMissing, []string{"retired"}) {
+		t.Errorf("result = %+v, want a pending change and retired missing", result)
+	}
+	retired := getTestModel(t, channel.Id, "retired")
+	if !retired.UpstreamMissing || !retired.Enabled {
+		t.Errorf("retired row: upstream missing %v, enabled %v, want flagged and left enabled", retired.UpstreamMissing, retired.Enabled)
+	}
+	if prompt := getTestModel(t, channel.Id, "gpt-4o").Config.Prompt; prompt != 1 {
+		t.Errorf("prompt price = %v before the approval, want 1", prompt)
+	}
+
+	// the same change is queued once
+	result, err = SyncModelPrices(channel.Id, upstream(1.5), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pending != 0 || len(getPendingPriceChanges(t, channel.Id)) != 1 {
+		t.Errorf("the same change was queued again")
+	}
+	// a newer price replaces the pending one
+	_, err = SyncModelPrices(channel.Id, upstream(2), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := getPendingPriceChanges(t, channel.Id)
+	if len(pending) != 1 || pending[0].NewPrice.Prompt != 2 || pending[0].OldPrice.Prompt != 1 {
+		t.Fatalf("pending changes = %+v, want the one to 2", pending)
+	}
+
+	_, err = ApprovePriceChange(pending[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApprovePriceChange(pending[0].Id); err == nil {
+		t.Errorf("a change was approved twice")
+	}
+	cfg := getTestModel(t, channel.Id, "gpt-4o").Config
+	if cfg.Prompt != 2 || cfg.Completion != 2 || cfg.ContextLength != 128000 {
+		t.Errorf("config after the approval = %+v, want the new price and the rest kept", cfg)
+	}
+
+	// applied at once, and the retired model is back
+	withRetired := append(upstream(2.5), &Model{Name: "retired", Config: &Config{}})
+	result, err = SyncModelPrices(channel.Id, withRetired, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Applied != 1 || len(result.UpstreamMissing) != 0 {
+		t.Errorf("result = %+v, want an applied change and nothing missing", result)
+	}
+	if prompt := getTestModel(t, channel.Id, "gpt-4o").Config.Prompt; prompt != 2.5 {
+		t.Errorf("prompt price = %v, want 2.5", prompt)
+	}
+	// an upstream without pricing is not a price of 0
+	retired = getTestModel(t, channel.Id, "retired")
+	if retired.UpstreamMissing || retired.Config.Prompt != 1 {
+		t.Errorf("retired row: upstream missing %v, prompt %v, want listed again at its price", retired.UpstreamMissing, retired.Config.Prompt)
+	}
+	var applied []*PriceChange
+	err = DB.Where("channel_id = ? and status = ?", channel.Id, PriceChangeStatusApplied).Order("id").Find(&applied).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].AutoApplied || !applied[1].AutoApplied {
+		t.Errorf("applied changes = %+v, want the approved one and the auto applied one", applied)
+	}
+}
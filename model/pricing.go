@@ -0,0 +1,165 @@
+package model
+
+import (
+	"fmt"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"sync"
+	"time"
+)
+
+// PriceTier replaces the prices of the model when the prompt is longer than PromptTokensAbove
+// and the request is made within the time window, if any. The prices left at 0 are the ones of the model,
+// then all of them are multiplied by Multiplier, which is 1 when it is not set.
+type PriceTier struct {
+	Name              string `json:"name,omitempty"`
+	PromptTokensAbove int    `json:"prompt_tokens_above,omitempty"`
+	// StartTime and EndTime are like "22:00" in PRICING_TIMEZONE, a window may cross midnight
+	StartTime       string  `json:"start_time,omitempty"`
+	EndTime         string  `json:"end_time,omitempty"`
+	Prompt          float64 `json:"prompt,omitempty"`
+	Completion      float64 `json:"completion,omitempty"`
+	InputCacheRead  float64 `json:"input_cache_read,omitempty"`
+	InputCacheWrite float64 `json:"input_cache_write,omitempty"`
+	Reasoning       float64 `json:"reasoning,omitempty"`
+	Multiplier      float64 `json:"multiplier,omitempty"`
+}
+
+var pricingLocation *time.Location
+var pricingLocationOnce sync.Once
+
+func getPricingLocation() *time.Location {
+	pricingLocationOnce.Do(func() {
+		location, err := time.LoadLocation(config.PricingTimezone)
+		if err != nil {
+			logger.SysError("invalid pricing timezone, using local time: " + err.Error())
+			location = time.Local
+		}
+		pricingLocation = location
+	})
+	return pricingLocation
+}
+
+// parseClock returns the minutes since midnight of a time like "22:00"
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("时间格式应为 HH:MM：%s", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (t *PriceTier) GetName(index int) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("tier-%d", index+1)
+}
+
+func (t *PriceTier) hasWindow() bool {
+	return t.StartTime != "" || t.EndTime != ""
+}
+
+// inWindow reports whether the time is within the window of the tier, a tier without window always is
+func (t *PriceTier) inWindow(now time.Time) bool {
+	if !t.hasWindow() {
+		return true
+	}
+	start, err := parseClock(t.StartTime)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(t.EndTime)
+	if err != nil {
+		return false
+	}
+	now = now.In(getPricingLocation())
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+func (t *PriceTier) Matches(promptTokens int, now time.Time) bool {
+	return promptTokens > t.PromptTokensAbove && t.inWindow(now)
+}
+
+func (t *PriceTier) Validate() error {
+	if t.PromptTokensAbove < 0 {
+		return fmt.Errorf("提示词阈值不能为负数")
+	}
+	if t.Prompt < 0 || t.Completion < 0 || t.InputCacheRead < 0 || t.InputCacheWrite < 0 || t.Reasoning < 0 || t.Multiplier < 0 {
+		return fmt.Errorf("价格不能为负数")
+	}
+	if t.hasWindow() {
+		_, err := parseClock(t.StartTime)
+		if err != nil {
+			return err
+		}
+		_, err = parseClock(t.EndTime)
+		if err != nil {
+			return err
+		}
+		if t.StartTime == t.EndTime {
+			return fmt.Errorf("开始时间和结束时间不能相同")
+		}
+	}
+	return nil
+}
+
+// ValidateTiers checks the tiers, which must be ordered by their prompt threshold
+func (c *Config) ValidateTiers() error {
+	if c == nil {
+		return nil
+	}
+	for i, tier := range c.Tiers {
+		err := tier.Validate()
+		if err != nil {
+			return fmt.Errorf("价格档位 %s：%s", tier.GetName(i), err.Error())
+		}
+		if i > 0 && tier.PromptTokensAbove < c.Tiers[i-1].PromptTokensAbove {
+			return fmt.Errorf("价格档位必须按提示词阈值从小到大排列")
+		}
+	}
+	return nil
+}
+
+// GetTier returns the config with the prices of the last tier which matches the request, and the name of that tier.
+// The name is empty when none matches and the flat prices are used. The returned config has no tiers,
+// so it can be passed again without changing.
+func (c Config) GetTier(promptTokens int, now time.Time) (Config, string) {
+	tiers := c.Tiers
+	c.Tiers = nil
+	for i := len(tiers) - 1; i >= 0; i-- {
+		tier := &tiers[i]
+		if !tier.Matches(promptTokens, now) {
+			continue
+		}
+		tiered := c
+		if tier.Prompt > 0 {
+			tiered.Prompt = tier.Prompt
+		}
+		if tier.Completion > 0 {
+			tiered.Completion = tier.Completion
+		}
+		if tier.InputCacheRead > 0 {
+			tiered.InputCacheRead = tier.InputCacheRead
+		}
+		if tier.InputCacheWrite > 0 {
+			tiered.InputCacheWrite = tier.InputCacheWrite
+		}
+		if tier.Reasoning > 0 {
+			tiered.Reasoning = tier.Reasoning
+		}
+		if tier.Multiplier > 0 {
+			tiered.Prompt *= tier.Multiplier
+			tiered.Completion *= tier.Multiplier
+			tiered.InputCacheRead *= tier.Multiplier
+			tiered.InputCacheWrite *= tier.Multiplier
+			tiered.Reasoning *= tier.Multiplier
+		}
+		return tiered, tier.GetName(i)
+	}
+	return c, ""
+}
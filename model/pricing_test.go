@@ -0,0 +1,98 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func init() {
+	// the windows of the tests are in UTC, whatever PRICING_TIMEZONE is
+	pricingLocationOnce.Do(func() {
+		pricingLocation = time.UTC
+	})
+}
+
+func at(clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2026, 1, 1, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func TestPriceTierInWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		now   string
+		want  bool
+	}{
+		{"no window", "", "", "12:00", true},
+		{"within", "09:00", "18:00", "12:00", true},
+		{"at start", "09:00", "18:00", "09:00", true},
+		{"at end", "09:00", "18:00", "18:00", false},
+		{"before", "09:00", "18:00", "08:59", false},
+		{"after", "09:00", "18:00", "23:00", false},
+		{"across midnight, late", "22:00", "06:00", "23:30", true},
+		{"across midnight, early", "22:00", "06:00", "05:59", true},
+		{"across midnight, at midnight", "22:00", "06:00", "00:00", true},
+		{"across midnight, at end", "22:00", "06:00", "06:00", false},
+		{"across midnight, daytime", "22:00", "06:00", "12:00", false},
+		{"invalid start", "25:00", "06:00", "05:00", false},
+		{"missing end", "22:00", "", "23:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tier := PriceTier{StartTime: tt.start, EndTime: tt.end}
+			if got := tier.inWindow(at(tt.now)); got != tt.want {
+				t.Errorf("inWindow(%s) = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigGetTier(t *testing.T) {
+	config := Config{
+		Prompt:         1,
+		Completion:     2,
+		InputCacheRead: 0.1,
+		Tiers: []PriceTier{
+			{Name: "night", StartTime: "22:00", EndTime: "06:00", Multiplier: 0.5},
+			{PromptTokensAbove: 1000, Prompt: 3, Completion: 4},
+		},
+	}
+	tests := []struct {
+		name         string
+		promptTokens int
+		now          string
+		wantTier     string
+		wantPrompt   float64
+		wantComplete float64
+		wantCache    float64
+	}{
+		{"flat", 100, "12:00", "", 1, 2, 0.1},
+		{"night", 100, "23:00", "night", 0.5, 1, 0.05},
+		{"long prompt", 2000, "12:00", "tier-2", 3, 4, 0.1},
+		{"long prompt at night takes the last tier", 2000, "23:00", "tier-2", 3, 4, 0.1},
+		{"at the threshold", 1000, "12:00", "", 1, 2, 0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiered, tier := config.GetTier(tt.promptTokens, at(tt.now))
+			if tier != tt.wantTier {
+				t.Errorf("tier = %q, want %q", tier, tt.wantTier)
+			}
+			if tiered.Prompt != tt.wantPrompt || tiered.Completion != tt.wantComplete || tiered.InputCacheRead != tt.wantCache {
+				t.Errorf("prices = %v/%v/%v, want %v/%v/%v", tiered.Prompt, tiered.Completion, tiered.InputCacheRead,
+					tt.wantPrompt, tt.wantComplete, tt.wantCache)
+			}
+			if len(tiered.Tiers) != 0 {
+				t.Errorf("the tiered config still has %d tiers", len(tiered.Tiers))
+			}
+		})
+	}
+	if len(config.Tiers) != 2 {
+		t.Errorf("GetTier changed the tiers of the config")
+	}
+}
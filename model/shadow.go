@@ -0,0 +1,208 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/logger"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Shadow mirrors a sample of the requests of a model to another channel or model,
+// the client only gets the primary response and the shadow outcome is stored in ShadowLog
+type Shadow struct {
+	Id              int     `json:"id"`
+	Model           string  `json:"model" gorm:"size:191;uniqueIndex"`
+	SampleRate      float64 `json:"sample_rate" gorm:"default:0"`       // from 0 to 1
+	TargetChannelId int     `json:"target_channel_id" gorm:"default:0"` // 0 means any channel of the target model
+	TargetModel     string  `json:"target_model" gorm:"default:''"`     // empty means the same model
+	RetentionDays   int     `json:"retention_days" gorm:"default:0"`    // 0 means the logs are kept forever
+	Enabled         bool    `json:"enabled" gorm:"default:false"`
+}
+
+type ShadowLog struct {
+	Id                      int       `json:"id"`
+	ShadowId                int       `json:"shadow_id" gorm:"index"`
+	CreatedAt               time.Time `json:"created_at" gorm:"index"`
+	RequestId               string    `json:"request_id" gorm:"index;default:''"`
+	ModelName               string    `json:"model_name" gorm:"default:''"`
+	ChannelId               int       `json:"channel"`
+	StatusCode              int       `json:"status_code"`
+	Error                   string    `json:"error" gorm:"type:text"`
+	ElapsedTime             int64     `json:"elapsed_time" gorm:"default:0"` // unit is ms
+	PromptTokens            int       `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens        int       `json:"completion_tokens" gorm:"default:0"`
+	Quota                   float64   `json:"quota" gorm:"default:0"`
+	ResponseText            string    `json:"response_text" gorm:"type:text"`
+	PrimaryModelName        string    `json:"primary_model_name" gorm:"default:''"`
+	PrimaryChannelId        int       `json:"primary_channel"`
+	PrimaryElapsedTime      int64     `json:"primary_elapsed_time" gorm:"default:0"`
+	PrimaryPromptTokens     int       `json:"primary_prompt_tokens" gorm:"default:0"`
+	PrimaryCompletionTokens int       `json:"primary_completion_tokens" gorm:"default:0"`
+	PrimaryQuota            float64   `json:"primary_quota" gorm:"default:0"`
+	PrimaryResponseText     string    `json:"primary_response_text" gorm:"type:text"`
+}
+
+func GetAllShadows(startIdx int, num int) ([]*Shadow, int64, error) {
+	var shadows []*Shadow
+	var total int64
+	err := DB.Model(&Shadow{}).Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	err = DB.Order("id desc").Limit(num).Offset(startIdx).Find(&shadows).Error
+	return shadows, total, err
+}
+
+func GetShadowById(id int) (*Shadow, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	shadow := Shadow{Id: id}
+	err := DB.First(&shadow, "id = ?", id).Error
+	return &shadow, err
+}
+
+// GetShadowByModel returns the enabled shadow of the model, or nil if there is none
+func GetShadowByModel(model string) (*Shadow, error) {
+	var shadow Shadow
+	err := DB.Where("model = ? and enabled = ?", model, true).First(&shadow).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &shadow, nil
+}
+
+func CacheGetShadowByModel(model string) (*Shadow, error) {
+	if !common.RedisEnabled {
+		return GetShadowByModel(model)
+	}
+	shadowStr, err := common.RedisGet(fmt.Sprintf("shadow:%s", model))
+	if err == nil {
+		if shadowStr == "" {
+			return nil, nil
+		}
+		var shadow Shadow
+		err = json.Unmarshal([]byte(shadowStr), &shadow)
+		return &shadow, err
+	}
+	shadow, err := GetShadowByModel(model)
+	if err != nil {
+		return nil, err
+	}
+	// the models without shadow are cached as well
+	shadowStr = ""
+	if shadow != nil {
+		jsonBytes, err := json.Marshal(shadow)
+		if err != nil {
+			return nil, err
+		}
+		shadowStr = string(jsonBytes)
+	}
+	err = common.RedisSet(fmt.Sprintf("shadow:%s", model), shadowStr, time.Duration(GroupModelsCacheSeconds)*time.Second)
+	if err != nil {
+		logger.SysError("Redis set shadow error: " + err.Error())
+	}
+	return shadow, nil
+}
+
+func cacheDeleteShadow(model string) {
+	if !common.RedisEnabled {
+		return
+	}
+	err := common.RedisDel(fmt.Sprintf("shadow:%s", model))
+	if err != nil {
+		logger.SysError("Redis delete shadow error: " + err.Error())
+	}
+}
+
+func (shadow *Shadow) Insert() error {
+	err := DB.Create(shadow).Error
+	if err != nil {
+		return err
+	}
+	cacheDeleteShadow(shadow.Model)
+	return nil
+}
+
+func (shadow *Shadow) Update() error {
+	oldShadow, err := GetShadowById(shadow.Id)
+	if err != nil {
+		return err
+	}
+	err = DB.Model(shadow).Select("model", "sample_rate", "target_channel_id", "target_model", "retention_days", "enabled").Updates(shadow).Error
+	if err != nil {
+		return err
+	}
+	cacheDeleteShadow(oldShadow.Model)
+	cacheDeleteShadow(shadow.Model)
+	return nil
+}
+
+func (shadow *Shadow) Delete() error {
+	err := DB.Delete(shadow).Error
+	if err != nil {
+		return err
+	}
+	cacheDeleteShadow(shadow.Model)
+	return nil
+}
+
+func DeleteShadowById(id int) error {
+	shadow, err := GetShadowById(id)
+	if err != nil {
+		return err
+	}
+	return shadow.Delete()
+}
+
+func RecordShadowLog(log *ShadowLog) error {
+	log.CreatedAt = time.Now()
+	return LOG_DB.Create(log).Error
+}
+
+func GetShadowLogs(shadowId int, startIdx int, num int) ([]*ShadowLog, int64, error) {
+	var logs []*ShadowLog
+	var total int64
+	tx := LOG_DB.Model(&ShadowLog{}).Where("shadow_id = ?", shadowId)
+	err := tx.Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&logs).Error
+	return logs, total, err
+}
+
+func deleteExpiredShadowLogs() {
+	var shadows []*Shadow
+	err := DB.Where("retention_days > 0").Find(&shadows).Error
+	if err != nil {
+		logger.SysError("failed to get shadows: " + err.Error())
+		return
+	}
+	for _, shadow := range shadows {
+		expiredTime := time.Now().AddDate(0, 0, -shadow.RetentionDays)
+		result := LOG_DB.Where("shadow_id = ? and created_at < ?", shadow.Id, expiredTime).Delete(&ShadowLog{})
+		if result.Error != nil {
+			logger.SysError("failed to delete expired shadow logs: " + result.Error.Error())
+			continue
+		}
+		if result.RowsAffected > 0 {
+			logger.SysLogf("deleted %d expired logs of shadow #%d", result.RowsAffected, shadow.Id)
+		}
+	}
+}
+
+// SyncShadowLogRetention deletes the expired shadow logs every hour, it must only run on the master node
+func SyncShadowLogRetention() {
+	for {
+		deleteExpiredShadowLogs()
+		time.Sleep(time.Hour)
+	}
+}
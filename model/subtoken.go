@@ -0,0 +1,281 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/logger"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// the chain of parents is walked at most this deep, in case of a broken chain
+const maxTokenDepth = 8
+
+// getTokenAncestors returns the parent, grandparent and so on of the token
+func getTokenAncestors(token *Token) ([]*Token, error) {
+	ancestors := make([]*Token, 0)
+	parentId := token.ParentId
+	for parentId != 0 {
+		if len(ancestors) >= maxTokenDepth {
+			return nil, errors.New("令牌层级过深")
+		}
+		parent, err := GetTokenById(parentId)
+		if err != nil {
+			return nil, err
+		}
+		ancestors = append(ancestors, parent)
+		parentId = parent.ParentId
+	}
+	return ancestors, nil
+}
+
+// validateTokenAncestors makes sure none of the ancestors is disabled, expired or out of budget.
+// The ancestors cached with the token are used when there are any.
+func validateTokenAncestors(token *Token) error {
+	if token.ParentId == 0 {
+		return nil
+	}
+	ancestors := token.Ancestors
+	if ancestors == nil {
+		var err error
+		ancestors, err = getTokenAncestors(token)
+		if err != nil {
+			logger.SysError("failed to get token ancestors: " + err.Error())
+			return errors.New("父令牌不可用")
+		}
+	}
+	now := time.Now()
+	for _, ancestor := range ancestors {
+		if ancestor.Status != TokenStatusEnabled && ancestor.Status != TokenStatusExhausted {
+			return fmt.Errorf("父令牌 %s（#%d）不可用", ancestor.Name, ancestor.Id)
+		}
+		if ancestor.ExpiredTime != nil && ancestor.ExpiredTime.Before(now) {
+			return fmt.Errorf("父令牌 %s（#%d）已过期", ancestor.Name, ancestor.Id)
+		}
+		if ancestor.HasBudget() && ancestor.GetPeriodUsedQuota(now) >= ancestor.BudgetAmount {
+			return fmt.Errorf("父令牌 %s（#%d）本期预算已用尽，将于 %s 重置", ancestor.Name, ancestor.Id,
+				ancestor.GetBudgetResetTime(now).Format("2006-01-02 15:04:05 MST"))
+		}
+	}
+	return nil
+}
+
+func getTokenAncestorIdsDB(tokenId int) ([]int, error) {
+	ids := make([]int, 0)
+	var token Token
+	err := DB.Select("id", "parent_id").First(&token, "id = ?", tokenId).Error
+	if err != nil {
+		return nil, err
+	}
+	for token.ParentId != 0 {
+		if len(ids) >= maxTokenDepth {
+			return nil, errors.New("令牌层级过深")
+		}
+		ids = append(ids, token.ParentId)
+		parentId := token.ParentId
+		token = Token{}
+		err = DB.Select("id", "parent_id").First(&token, "id = ?", parentId).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// getTokenAncestorIds returns the ids of the ancestors, which are cached as the parent of a token never changes
+func getTokenAncestorIds(tokenId int) ([]int, error) {
+	if !common.RedisEnabled {
+		return getTokenAncestorIdsDB(tokenId)
+	}
+	key := fmt.Sprintf("token_ancestors:%d", tokenId)
+	idsString, err := common.RedisGet(key)
+	if err == nil {
+		ids := make([]int, 0)
+		for _, id := range strings.Split(idsString, ",") {
+			if id == "" {
+				continue
+			}
+			parentId, err := strconv.Atoi(id)
+			if err != nil {
+				return getTokenAncestorIdsDB(tokenId)
+			}
+			ids = append(ids, parentId)
+		}
+		return ids, nil
+	}
+	ids, err := getTokenAncestorIdsDB(tokenId)
+	if err != nil {
+		return nil, err
+	}
+	idStrings := make([]string, 0, len(ids))
+	for _, id := range ids {
+		idStrings = append(idStrings, strconv.Itoa(id))
+	}
+	err = common.RedisSet(key, strings.Join(idStrings, ","), time.Duration(TokenCacheSeconds)*time.Second)
+	if err != nil {
+		logger.SysError("Redis set token ancestors error: " + err.Error())
+	}
+	return ids, nil
+}
+
+// rollUpTokenQuota adds the spend of the token to the used quota of every ancestor, a refund is a negative spend.
+// The spend of the budget periods differs when a part of it was reserved already.
+// The remain quota of the ancestors is untouched, the budget of a child is carved out of it on creation.
+func rollUpTokenQuota(tokenId int, quota float64, periodQuota float64) error {
+	if quota == 0 && periodQuota == 0 {
+		return nil
+	}
+	ancestorIds, err := getTokenAncestorIds(tokenId)
+	if err != nil {
+		return err
+	}
+	for _, ancestorId := range ancestorIds {
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&Token{}).Where("id = ?", ancestorId).Update("used_quota", gorm.Expr("used_quota + ?", quota)).Error
+			if err != nil {
+				return err
+			}
+			return updateTokenPeriodQuota(tx, ancestorId, periodQuota)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetChildTokens(parentId int) ([]*Token, error) {
+	var tokens []*Token
+	err := DB.Where("parent_id = ?", parentId).Order("id desc").Find(&tokens).Error
+	return tokens, err
+}
+
+// InsertChildToken creates the child and moves its remain quota out of the parent
+func InsertChildToken(parent *Token, child *Token) error {
+	child.ParentId = parent.Id
+	child.UserId = parent.UserId
+	if child.UnlimitedQuota && !parent.UnlimitedQuota {
+		return errors.New("父令牌额度有限，无法创建无限额度的子令牌")
+	}
+	// a deeper child would fail every request, see getTokenAncestors
+	parentAncestorIds, err := getTokenAncestorIds(parent.Id)
+	if err != nil {
+		return err
+	}
+	if len(parentAncestorIds)+1 > maxTokenDepth {
+		return fmt.Errorf("令牌层级不能超过 %d 层", maxTokenDepth)
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if !parent.UnlimitedQuota && child.RemainQuota > 0 {
+			result := tx.Model(&Token{}).Where("id = ? and remain_quota >= ?", parent.Id, child.RemainQuota).
+				Update("remain_quota", gorm.Expr("remain_quota - ?", child.RemainQuota))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errors.New("父令牌剩余额度不足")
+			}
+		}
+		return tx.Create(child).Error
+	})
+	if err == nil {
+		adjustCachedTokenQuota(parent.Id, -child.RemainQuota)
+	}
+	return err
+}
+
+// RevokeChildToken deletes the child with its own children, the unspent quota goes back to the parent
+func RevokeChildToken(parent *Token, childId int) error {
+	var child Token
+	err := DB.First(&child, "id = ? and parent_id = ?", childId, parent.Id).Error
+	if err != nil {
+		return err
+	}
+	subtree := []*Token{&child}
+	for i := 0; i < len(subtree) && i < 1000; i++ {
+		children, err := GetChildTokens(subtree[i].Id)
+		if err != nil {
+			return err
+		}
+		subtree = append(subtree, children...)
+	}
+	var refund float64
+	ids := make([]int, 0, len(subtree))
+	for _, token := range subtree {
+		ids = append(ids, token.Id)
+		if !token.UnlimitedQuota && token.RemainQuota > 0 {
+			refund += token.RemainQuota
+		}
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&Token{}, ids).Error
+		if err != nil {
+			return err
+		}
+		if parent.UnlimitedQuota || refund == 0 {
+			return nil
+		}
+		return tx.Model(&Token{}).Where("id = ?", parent.Id).Update("remain_quota", gorm.Expr("remain_quota + ?", refund)).Error
+	})
+	if err != nil {
+		return err
+	}
+	if !parent.UnlimitedQuota {
+		adjustCachedTokenQuota(parent.Id, refund)
+	}
+	for _, token := range subtree {
+		invalidateCachedTokenQuota(token.Id)
+		deleteCachedToken(token)
+		if common.RedisEnabled {
+			_ = common.RedisDel(fmt.Sprintf("token_ancestors:%d", token.Id))
+		}
+	}
+	return nil
+}
+
+// deleteCachedToken drops the cached token under its current and previous keys
+func deleteCachedToken(token *Token) {
+	if !common.RedisEnabled {
+		return
+	}
+	keys := []string{token.Key}
+	if token.PreviousKey != nil {
+		keys = append(keys, *token.PreviousKey)
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		err := common.RedisDel(fmt.Sprintf("token:%s", key))
+		if err != nil {
+			logger.SysError("Redis delete token error: " + err.Error())
+		}
+	}
+}
+
+// invalidateCachedTokenTree drops the cached token and its descendants, which keep the token in their cached ancestors,
+// so a disabled or deleted token stops its children at once
+func invalidateCachedTokenTree(token *Token) {
+	if !common.RedisEnabled {
+		return
+	}
+	deleteCachedToken(token)
+	parents := []int{token.Id}
+	for depth := 0; len(parents) > 0 && depth < maxTokenDepth; depth++ {
+		var children []*Token
+		err := DB.Select("id", "key", "previous_key").Where("parent_id in ?", parents).Find(&children).Error
+		if err != nil {
+			logger.SysError("failed to get child tokens: " + err.Error())
+			return
+		}
+		parents = parents[:0]
+		for _, child := range children {
+			deleteCachedToken(child)
+			parents = append(parents, child.Id)
+		}
+	}
+}
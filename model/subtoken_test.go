@@ -0,0 +1,146 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestInsertChildToken(t *testing.T) {
+	setupTestDB(t)
+	parent := createTestToken(t, &Token{Name: "parent", RemainQuota: 10})
+
+	child := &Token{Name: "child", RemainQuota: 4}
+	child.GenerateKey()
+	err := InsertChildToken(parent, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remain := getTestToken(t, parent.Id).RemainQuota; remain != 6 {
+		t.Errorf("remain quota of the parent = %v, want 6", remain)
+	}
+
+	tooMuch := &Token{Name: "too much", RemainQuota: 7}
+	tooMuch.GenerateKey()
+	if err := InsertChildToken(parent, tooMuch); err == nil {
+		t.Errorf("a child above the remain quota of the parent was created")
+	}
+	unlimited := &Token{Name: "unlimited", UnlimitedQuota: true}
+	unlimited.GenerateKey()
+	if err := InsertChildToken(parent, unlimited); err == nil {
+		t.Errorf("an unlimited child of a limited parent was created")
+	}
+}
+
+func TestInsertChildTokenDepth(t *testing.T) {
+	setupTestDB(t)
+	token := createTestToken(t, &Token{Name: "root", UnlimitedQuota: true})
+	for depth := 1; depth <= maxTokenDepth; depth++ {
+		child := &Token{Name: "child", UnlimitedQuota: true}
+		child.GenerateKey()
+		err := InsertChildToken(token, child)
+		if err != nil {
+			t.Fatalf("child at depth %d: %v", depth, err)
+		}
+		token = child
+	}
+	if _, err := getTokenAncestors(token); err != nil {
+		t.Fatalf("the deepest child can't be validated: %v", err)
+	}
+	child := &Token{Name: "too deep", UnlimitedQuota: true}
+	child.GenerateKey()
+	if err := InsertChildToken(token, child); err == nil {
+		t.Errorf("a child deeper than %d was created", maxTokenDepth)
+	}
+}
+
+func TestValidateTokenAncestors(t *testing.T) {
+	setupTestDB(t)
+	parent := createTestToken(t, &Token{Name: "parent", UnlimitedQuota: true})
+	child := createTestToken(t, &Token{Name: "child", ParentId: parent.Id, UnlimitedQuota: true})
+	if err := validateTokenAncestors(child); err != nil {
+		t.Fatalf("child of an enabled parent: %v", err)
+	}
+	err := DB.Model(&Token{}).Where("id = ?", parent.Id).Update("status", TokenStatusDisabled).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateTokenAncestors(child); err == nil {
+		t.Errorf("child of a disabled parent was valid")
+	}
+}
+
+func TestRollUpTokenQuota(t *testing.T) {
+	setupTestDB(t)
+	grandparent := createTestToken(t, &Token{Name: "grandparent", UnlimitedQuota: true})
+	parent := createTestToken(t, &Token{Name: "parent", ParentId: grandparent.Id, UnlimitedQuota: true})
+	child := createTestToken(t, &Token{Name: "child", ParentId: parent.Id, RemainQuota: 10})
+
+	err := SettleTokenQuota(child.Id, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a refund rolls back as well
+	err = PostConsumeTokenQuota(child.Id, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []*Token{child, parent, grandparent} {
+		if used := getTestToken(t, token.Id).UsedQuota; used != 2 {
+			t.Errorf("used quota of %s = %v, want 2", token.Name, used)
+		}
+	}
+}
+
+func TestRevokeChildToken(t *testing.T) {
+	setupTestDB(t)
+	parent := createTestToken(t, &Token{Name: "parent", RemainQuota: 10})
+	child := &Token{Name: "child", RemainQuota: 6}
+	child.GenerateKey()
+	if err := InsertChildToken(parent, child); err != nil {
+		t.Fatal(err)
+	}
+	grandchild := &Token{Name: "grandchild", RemainQuota: 2}
+	grandchild.GenerateKey()
+	if err := InsertChildToken(child, grandchild); err != nil {
+		t.Fatal(err)
+	}
+
+	err := RevokeChildToken(parent, child.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unspent quota of the whole subtree goes back
+	if remain := getTestToken(t, parent.Id).RemainQuota; remain != 10 {
+		t.Errorf("remain quota of the parent = %v, want 10", remain)
+	}
+	var count int64
+	DB.Model(&Token{}).Where("id in ?", []int{child.Id, grandchild.Id}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d tokens of the subtree are left", count)
+	}
+}
+
+func TestTokenHasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes string
+		scope  string
+		want   bool
+	}{
+		{"no scopes allow the relay", "", TokenScopeChat, true},
+		{"no scopes deny the proxy", "", TokenScopeProxy, false},
+		{"no scopes deny minting children", "", TokenScopeChildTokens, false},
+		{"listed", "chat,tokens:children", TokenScopeChildTokens, true},
+		{"not listed", "chat", TokenScopeEmbeddings, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := Token{}
+			if tt.scopes != "" {
+				token.Scopes = &tt.scopes
+			}
+			if got := token.HasScope(tt.scope); got != tt.want {
+				t.Errorf("HasScope(%q) = %v, want %v", tt.scope, got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"github.com/eloxt/llmhub/common"
 	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/relay/relaymode"
+	"net/netip"
+	"slices"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -18,18 +22,201 @@ const (
 	TokenStatusExhausted = 4
 )
 
+const (
+	TokenScopeChat        = "chat"
+	TokenScopeCompletions = "completions"
+	TokenScopeEmbeddings  = "embeddings"
+	TokenScopeModerations = "moderations"
+	TokenScopeImages      = "images"
+	TokenScopeAudio       = "audio"
+	TokenScopeProxy       = "proxy"
+	TokenScopeModelsList  = "models:list"
+	TokenScopeChildTokens = "tokens:children"
+)
+
+var TokenScopes = []string{
+	TokenScopeChat, TokenScopeCompletions, TokenScopeEmbeddings, TokenScopeModerations,
+	TokenScopeImages, TokenScopeAudio, TokenScopeProxy, TokenScopeModelsList, TokenScopeChildTokens,
+}
+
+// explicitScopes are never granted to a token without scopes
+var explicitScopes = []string{TokenScopeProxy, TokenScopeChildTokens}
+
+// GetScopeByRelayMode returns the scope a token needs for the relay mode, empty for the unknown modes
+func GetScopeByRelayMode(mode int) string {
+	switch mode {
+	case relaymode.ChatCompletions:
+		return TokenScopeChat
+	case relaymode.Completions, relaymode.Edits:
+		return TokenScopeCompletions
+	case relaymode.Embeddings:
+		return TokenScopeEmbeddings
+	case relaymode.Moderations:
+		return TokenScopeModerations
+	case relaymode.ImagesGenerations:
+		return TokenScopeImages
+	case relaymode.AudioSpeech, relaymode.AudioTranscription, relaymode.AudioTranslation:
+		return TokenScopeAudio
+	case relaymode.Proxy:
+		return TokenScopeProxy
+	}
+	return ""
+}
+
 type Token struct {
-	Id             int        `json:"id"`
-	UserId         int        `json:"user_id"`
-	Key            string     `json:"key" gorm:"type:char(48);uniqueIndex"`
-	Status         int        `json:"status" gorm:"default:1"`
-	Name           string     `json:"name" gorm:"index" `
-	CreatedTime    time.Time  `json:"created_time"`
-	AccessedTime   time.Time  `json:"accessed_time"`
-	ExpiredTime    *time.Time `json:"expired_time"` // null means never expired
-	RemainQuota    float64    `json:"remain_quota" gorm:"default:0"`
-	UnlimitedQuota bool       `json:"unlimited_quota" gorm:"default:false"`
-	UsedQuota      float64    `json:"used_quota" gorm:"default:0"`
+	Id        int    `json:"id"`
+	UserId    int    `json:"user_id"`
+	Key       string `json:"-" gorm:"type:char(64);uniqueIndex"` // HMAC of the key, see HashTokenKey
+	KeyPrefix string `json:"key_prefix" gorm:"type:varchar(16);default:''"`
+	// KeyGeneration counts the rotations, the previous key stays valid until PreviousKeyExpiredTime
+	KeyGeneration          int        `json:"key_generation" gorm:"default:1"`
+	PreviousKey            *string    `json:"-" gorm:"type:char(64);index"`
+	PreviousKeyExpiredTime *time.Time `json:"previous_key_expired_time"`
+	Status                 int        `json:"status" gorm:"default:1"`
+	Name                   string     `json:"name" gorm:"index" `
+	CreatedTime            time.Time  `json:"created_time"`
+	AccessedTime           time.Time  `json:"accessed_time"`
+	ExpiredTime            *time.Time `json:"expired_time"` // null means never expired
+	RemainQuota            float64    `json:"remain_quota" gorm:"default:0"`
+	UnlimitedQuota         bool       `json:"unlimited_quota" gorm:"default:false"`
+	UsedQuota              float64    `json:"used_quota" gorm:"default:0"`
+	// HedgeDelay overrides the hedge delay of the models in milliseconds, 0 means following the model and -1 disables hedging
+	HedgeDelay int `json:"hedge_delay" gorm:"default:0"`
+	// Group must be one of the groups of the user, empty means the first one
+	Group string `json:"group" gorm:"type:varchar(32);default:''"`
+	// Models is a comma separated list of the allowed models, "*" matches any characters, empty means all models
+	Models *string `json:"models" gorm:"type:text"`
+	// Subnet is a comma separated list of the allowed client IPs or CIDRs, empty means any address
+	Subnet *string `json:"subnet" gorm:"type:text"`
+	// requests and tokens per minute, 0 means unlimited
+	RPM int `json:"rpm" gorm:"default:0"`
+	TPM int `json:"tpm" gorm:"default:0"`
+	// BudgetPeriod is daily, weekly or monthly, the token may spend BudgetAmount in each period, empty means no budget
+	BudgetPeriod    string     `json:"budget_period" gorm:"type:varchar(16);default:''"`
+	BudgetAmount    float64    `json:"budget_amount" gorm:"default:0"`
+	PeriodUsedQuota float64    `json:"period_used_quota" gorm:"default:0"`
+	PeriodStartTime *time.Time `json:"period_start_time"`
+	// ParentId is the token which minted this one, its remain quota was carved out of the parent's
+	ParentId int `json:"parent_id" gorm:"index;default:0"`
+	// Scopes is a comma separated list of the allowed endpoints, empty means all of them except the proxy
+	Scopes *string `json:"scopes" gorm:"type:varchar(255)"`
+
+	// ParamPolicy guards the parameters of the requests, see ParamRule
+	ParamPolicy ParamPolicy `json:"param_policy" gorm:"type:text;serializer:json"`
+	// Tags are the default cost attribution tags of the requests, like "project=search,env=prod"
+	Tags *string `json:"tags" gorm:"type:varchar(1024)"`
+	// FullKey is only set when the token is created, the key can't be recovered afterwards
+	FullKey string `json:"key,omitempty" gorm:"-:all"`
+	// AuthKeyGeneration is the generation of the key which authenticated the request
+	AuthKeyGeneration int `json:"-" gorm:"-:all"`
+	// Ancestors are the parent, grandparent and so on, cached with the token
+	Ancestors []*Token `json:"-" gorm:"-:all"`
+}
+
+func (t *Token) GetModels() []string {
+	if t.Models == nil {
+		return nil
+	}
+	return splitCommaList(*t.Models)
+}
+
+func (t *Token) GetScopes() []string {
+	if t.Scopes == nil {
+		return nil
+	}
+	return splitCommaList(*t.Scopes)
+}
+
+// HasScope reports whether the token may call the endpoints of the scope, the proxy must always be granted explicitly
+func (t *Token) HasScope(scope string) bool {
+	scopes := t.GetScopes()
+	if len(scopes) == 0 {
+		return !slices.Contains(explicitScopes, scope)
+	}
+	return slices.Contains(scopes, scope)
+}
+
+// AllowsModel reports whether the token may use the model
+func (t *Token) AllowsModel(name string) bool {
+	patterns := t.GetModels()
+	return len(patterns) == 0 || MatchModelPatterns(patterns, name)
+}
+
+// MatchModelPatterns reports whether the name matches one of the patterns, "*" matches any characters
+func MatchModelPatterns(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchModelPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchModelPattern(pattern string, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(name, part)
+		if idx < 0 {
+			return false
+		}
+		name = name[idx+len(part):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// GetSubnets parses the allowlist of the token, bare IPs are turned into single address prefixes
+func (t *Token) GetSubnets() ([]netip.Prefix, error) {
+	if t.Subnet == nil {
+		return nil, nil
+	}
+	prefixes := make([]netip.Prefix, 0)
+	for _, subnet := range splitCommaList(*t.Subnet) {
+		if !strings.Contains(subnet, "/") {
+			addr, err := netip.ParseAddr(subnet)
+			if err != nil {
+				return nil, fmt.Errorf("无效的 IP 地址：%s", subnet)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段：%s", subnet)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// AllowsIP reports whether the client IP is in the allowlist of the token
+func (t *Token) AllowsIP(ip string) bool {
+	prefixes, err := t.GetSubnets()
+	if err != nil {
+		// the list is validated on save, a broken one denies everything
+		return false
+	}
+	if len(prefixes) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 func GetAllUserTokens(userId int, startIdx int, num int, keyword string) ([]*Token, int64, error) {
@@ -66,6 +253,14 @@ func ValidateUserToken(key string) (token *Token, err error) {
 		}
 		return nil, errors.New("令牌验证失败")
 	}
+	token.AuthKeyGeneration = token.KeyGeneration
+	if token.Key != HashTokenKey(key) {
+		// authenticated by the key before the last rotation
+		if token.PreviousKeyExpiredTime == nil || token.PreviousKeyExpiredTime.Before(time.Now()) {
+			return nil, errors.New("该密钥已轮换并过期，请使用新密钥")
+		}
+		token.AuthKeyGeneration = token.KeyGeneration - 1
+	}
 	if token.Status == TokenStatusExhausted {
 		return nil, fmt.Errorf("令牌 %s（#%d）额度已用尽", token.Name, token.Id)
 	} else if token.Status == TokenStatusExpired {
@@ -95,6 +290,17 @@ func ValidateUserToken(key string) (token *Token, err error) {
 		}
 		return nil, errors.New("该令牌额度已用尽")
 	}
+	if token.HasBudget() {
+		now := time.Now()
+		if token.GetPeriodUsedQuota(now) >= token.BudgetAmount {
+			resetTime := token.GetBudgetResetTime(now)
+			return nil, fmt.Errorf("令牌 %s（#%d）本期预算已用尽，将于 %s 重置", token.Name, token.Id, resetTime.Format("2006-01-02 15:04:05 MST"))
+		}
+	}
+	err = validateTokenAncestors(token)
+	if err != nil {
+		return nil, err
+	}
 	return token, nil
 }
 
@@ -127,7 +333,11 @@ func (t *Token) Insert() error {
 // Update Make sure your token's fields is completed, because this will update non-zero values
 func (t *Token) Update() error {
 	var err error
-	err = DB.Model(t).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota", "models", "subnet").Updates(t).Error
+	err = DB.Model(t).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota", "models", "subnet", "hedge_delay", "group", "rpm", "tpm", "budget_period", "budget_amount", "scopes", "param_policy", "tags").Updates(t).Error
+	if err == nil {
+		invalidateCachedTokenQuota(t.Id)
+		invalidateCachedTokenTree(t)
+	}
 	return err
 }
 
@@ -139,6 +349,9 @@ func (t *Token) SelectUpdate() error {
 func (t *Token) Delete() error {
 	var err error
 	err = DB.Delete(t).Error
+	if err == nil {
+		invalidateCachedTokenTree(t)
+	}
 	return err
 }
 
@@ -161,20 +374,30 @@ func IncreaseTokenQuota(id int, quota float64) (err error) {
 	}
 	if config.BatchUpdateEnabled {
 		addNewRecord(BatchUpdateTypeTokenQuota, id, quota)
-		return nil
+	} else {
+		err = increaseTokenQuota(id, quota)
+		if err != nil {
+			return err
+		}
 	}
-	return increaseTokenQuota(id, quota)
+	adjustCachedTokenQuota(id, quota)
+	return rollUpTokenQuota(id, -quota, -quota)
 }
 
 func increaseTokenQuota(id int, quota float64) (err error) {
-	err = DB.Model(&Token{}).Where("id = ?", id).Updates(
-		map[string]interface{}{
-			"remain_quota":  gorm.Expr("remain_quota + ?", quota),
-			"used_quota":    gorm.Expr("used_quota - ?", quota),
-			"accessed_time": time.Now(),
-		},
-	).Error
-	return err
+	return DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Token{}).Where("id = ?", id).Updates(
+			map[string]interface{}{
+				"remain_quota":  gorm.Expr("remain_quota + ?", quota),
+				"used_quota":    gorm.Expr("used_quota - ?", quota),
+				"accessed_time": time.Now(),
+			},
+		).Error
+		if err != nil {
+			return err
+		}
+		return updateTokenPeriodQuota(tx, id, -quota)
+	})
 }
 
 func DecreaseTokenQuota(id int, quota float64) (err error) {
@@ -183,30 +406,35 @@ func DecreaseTokenQuota(id int, quota float64) (err error) {
 	}
 	if config.BatchUpdateEnabled {
 		addNewRecord(BatchUpdateTypeTokenQuota, id, -quota)
-		return nil
+	} else {
+		err = decreaseTokenQuota(id, quota)
+		if err != nil {
+			return err
+		}
 	}
-	return decreaseTokenQuota(id, quota)
+	adjustCachedTokenQuota(id, -quota)
+	return rollUpTokenQuota(id, quota, quota)
 }
 
 func decreaseTokenQuota(id int, quota float64) (err error) {
-	err = DB.Model(&Token{}).Where("id = ?", id).Updates(
-		map[string]interface{}{
-			"remain_quota":  gorm.Expr("remain_quota - ?", quota),
-			"used_quota":    gorm.Expr("used_quota + ?", quota),
-			"accessed_time": time.Now(),
-		},
-	).Error
-	return err
+	return DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Token{}).Where("id = ?", id).Updates(
+			map[string]interface{}{
+				"remain_quota":  gorm.Expr("remain_quota - ?", quota),
+				"used_quota":    gorm.Expr("used_quota + ?", quota),
+				"accessed_time": time.Now(),
+			},
+		).Error
+		if err != nil {
+			return err
+		}
+		return updateTokenPeriodQuota(tx, id, quota)
+	})
 }
 
 func PostConsumeTokenQuota(tokenId int, quota float64) (err error) {
 	if quota > 0 {
-		err = DecreaseTokenQuota(tokenId, quota)
-	} else {
-		err = IncreaseTokenQuota(tokenId, -quota)
-	}
-	if err != nil {
-		return err
+		return DecreaseTokenQuota(tokenId, quota)
 	}
-	return nil
+	return IncreaseTokenQuota(tokenId, -quota)
 }
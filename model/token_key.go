@@ -0,0 +1,138 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/common/random"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const tokenKeySecretOption = "TokenKeySecret"
+
+// the length of the start of the key shown in the token list
+const tokenKeyPrefixLength = 6
+
+var tokenKeySecret string
+
+// HashTokenKey returns what is stored and cached for a key, the key itself is only known to its owner
+func HashTokenKey(key string) string {
+	return common.HmacSha256(tokenKeySecret, key)
+}
+
+// SetKey stores the hash of the key, the key is kept in FullKey to be returned once on creation
+func (t *Token) SetKey(key string) {
+	t.Key = HashTokenKey(key)
+	t.KeyPrefix = key[:min(len(key), tokenKeyPrefixLength)]
+	t.FullKey = key
+}
+
+func (t *Token) GenerateKey() {
+	t.SetKey(random.GenerateKey())
+}
+
+// RotateKey issues a new key for the token, the current one keeps working for the grace period
+func (t *Token) RotateKey(gracePeriod time.Duration) error {
+	oldKey := t.Key
+	// the key of the previous rotation stops working at once
+	oldPreviousKey := t.PreviousKey
+	expiredTime := time.Now().Add(gracePeriod)
+	t.PreviousKey = &oldKey
+	t.PreviousKeyExpiredTime = &expiredTime
+	t.KeyGeneration++
+	t.GenerateKey()
+	err := DB.Model(t).Select("key", "key_prefix", "key_generation", "previous_key", "previous_key_expired_time").Updates(t).Error
+	if err != nil {
+		return err
+	}
+	if common.RedisEnabled {
+		// the cached token still has the old key as the current one
+		err = common.RedisDel(fmt.Sprintf("token:%s", oldKey))
+		if err != nil {
+			logger.SysError("Redis delete token error: " + err.Error())
+		}
+		if oldPreviousKey != nil {
+			err = common.RedisDel(fmt.Sprintf("token:%s", *oldPreviousKey))
+			if err != nil {
+				logger.SysError("Redis delete token error: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// initTokenKeySecret uses TOKEN_KEY_SECRET, or a random secret generated on the first start and kept in the options
+func initTokenKeySecret() {
+	if config.TokenKeySecret != "" {
+		tokenKeySecret = config.TokenKeySecret
+		return
+	}
+	keyCol := "`key`"
+	if common.UsingPostgreSQL {
+		keyCol = `"key"`
+	}
+	var option Option
+	err := DB.Where(keyCol+" = ?", tokenKeySecretOption).First(&option).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			logger.FatalLog("failed to generate token key secret: " + err.Error())
+		}
+		option = Option{Key: tokenKeySecretOption, Value: hex.EncodeToString(secret)}
+		err = DB.Create(&option).Error
+		if err != nil {
+			// created by another node at the same time
+			err = DB.Where(keyCol+" = ?", tokenKeySecretOption).First(&option).Error
+		}
+	}
+	if err != nil {
+		logger.FatalLog("failed to initialize token key secret: " + err.Error())
+	}
+	tokenKeySecret = option.Value
+}
+
+// isHashedTokenKey reports whether the stored key is a hash made by HashTokenKey, the plaintext keys are 48 characters long
+func isHashedTokenKey(key string) bool {
+	if len(key) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil && strings.ToLower(key) == key
+}
+
+// migrateTokenKeys hashes the keys stored in plaintext by the previous versions, the clients keep using the same keys
+func migrateTokenKeys() error {
+	var tokens []*Token
+	err := DB.Select("id", "key").Find(&tokens).Error
+	if err != nil {
+		return err
+	}
+	plaintext := make([]*Token, 0)
+	for _, token := range tokens {
+		// char columns may come back padded
+		token.Key = strings.TrimSpace(token.Key)
+		if !isHashedTokenKey(token.Key) {
+			plaintext = append(plaintext, token)
+		}
+	}
+	if len(plaintext) == 0 {
+		return nil
+	}
+	logger.SysLogf("hashing the keys of %d tokens", len(plaintext))
+	for _, token := range plaintext {
+		token.SetKey(token.Key)
+		err = DB.Model(token).Select("key", "key_prefix").Updates(token).Error
+		if err != nil {
+			return fmt.Errorf("failed to hash the key of token #%d: %w", token.Id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"github.com/eloxt/llmhub/common/random"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsHashedTokenKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"hash", HashTokenKey("sk-test"), true},
+		{"plaintext", random.GenerateKey(), false},
+		{"upper case", strings.ToUpper(HashTokenKey("sk-test")), false},
+		{"not hex", strings.Repeat("z", 64), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isHashedTokenKey(tt.key); got != tt.want {
+				t.Errorf("isHashedTokenKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateTokenKeys(t *testing.T) {
+	setupTestDB(t)
+	saved := tokenKeySecret
+	t.Cleanup(func() {
+		tokenKeySecret = saved
+	})
+	initTokenKeySecret()
+	secret := tokenKeySecret
+	if secret == "" {
+		t.Fatalf("no token key secret generated")
+	}
+	// the secret is kept for the next start
+	initTokenKeySecret()
+	if tokenKeySecret != secret {
+		t.Errorf("another token key secret generated on the next start")
+	}
+
+	plaintextKey := random.GenerateKey()
+	plaintext := createTestToken(t, &Token{Name: "plaintext", RemainQuota: 10})
+	err := DB.Model(&Token{}).Where("id = ?", plaintext.Id).Updates(map[string]any{"key": plaintextKey, "key_prefix": ""}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := createTestToken(t, &Token{Name: "hashed", RemainQuota: 10})
+
+	for i := 0; i < 2; i++ {
+		err = migrateTokenKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrated := getTestToken(t, plaintext.Id)
+	if migrated.Key != HashTokenKey(plaintextKey) || migrated.KeyPrefix != plaintextKey[:tokenKeyPrefixLength] {
+		t.Errorf("key %q with prefix %q, want the hash of the plaintext key", migrated.Key, migrated.KeyPrefix)
+	}
+	if getTestToken(t, hashed.Id).Key != hashed.Key {
+		t.Errorf("a hashed key was hashed again")
+	}
+	// the clients keep using the same key
+	token, err := ValidateUserToken(plaintextKey)
+	if err != nil || token.Id != plaintext.Id {
+		t.Errorf("ValidateUserToken() with the migrated key = %v, %v", token, err)
+	}
+	if _, err := ValidateUserToken(HashTokenKey(plaintextKey)); err == nil {
+		t.Errorf("the stored hash authenticated as a key")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	setupTestDB(t)
+	token := createTestToken(t, &Token{Name: "rotated", RemainQuota: 10})
+	firstKey := token.FullKey
+
+	err := token.RotateKey(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKey := token.FullKey
+	authenticated, err := ValidateUserToken(secondKey)
+	if err != nil || authenticated.AuthKeyGeneration != 2 {
+		t.Fatalf("ValidateUserToken() with the new key = %v, %v", authenticated, err)
+	}
+	// the old key works within the grace period, as the previous generation
+	authenticated, err = ValidateUserToken(firstKey)
+	if err != nil || authenticated.AuthKeyGeneration != 1 {
+		t.Fatalf("ValidateUserToken() with the old key = %v, %v", authenticated, err)
+	}
+
+	err = token.RotateKey(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateUserToken(firstKey); err == nil {
+		t.Errorf("the key of two rotations ago still works")
+	}
+	if _, err := ValidateUserToken(secondKey); err != nil {
+		t.Errorf("the previous key stopped working within the grace period: %v", err)
+	}
+
+	// no grace period
+	err = token.RotateKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateUserToken(token.FullKey); err != nil {
+		t.Errorf("ValidateUserToken() with the new key = %v", err)
+	}
+	if _, err := ValidateUserToken(secondKey); err == nil {
+		t.Errorf("the previous key still works after the grace period")
+	}
+	if generation := getTestToken(t, token.Id).KeyGeneration; generation != 4 {
+		t.Errorf("key generation = %d, want 4", generation)
+	}
+}
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/logger"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TokenRateLimit is the state of a per-minute limit of a token after a request
+type TokenRateLimit struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is when the bucket is full again, RetryAfter is when the rejected request would be accepted
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// the bucket refills limit tokens per minute, it's full again once the key expires
+var tokenBucketScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local need = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or limit
+local ts = tonumber(state[2]) or now
+tokens = math.min(limit, tokens + math.max(0, now - ts) * limit / 60000)
+local allowed = 0
+if tokens >= need then
+	tokens = tokens - cost
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((limit - tokens) * 60000 / limit) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+type tokenBucket struct {
+	tokens    float64
+	limit     int
+	updatedAt time.Time
+}
+
+var tokenBuckets = make(map[string]*tokenBucket)
+var tokenBucketsLock sync.Mutex
+var tokenBucketsSweptAt time.Time
+
+// refill adds the tokens gained since the last update, up to the limit
+func (bucket *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.updatedAt).Minutes()
+	bucket.tokens = math.Min(float64(bucket.limit), bucket.tokens+max(0, elapsed)*float64(bucket.limit))
+	bucket.updatedAt = now
+}
+
+// sweepTokenBuckets drops the buckets which are full again, a missing bucket is the same as a full one.
+// It must be called with the lock held.
+func sweepTokenBuckets(now time.Time) {
+	tokenBucketsSweptAt = now
+	for key, bucket := range tokenBuckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit) {
+			delete(tokenBuckets, key)
+		}
+	}
+}
+
+func tokenBucketKey(kind string, tokenId int) string {
+	return fmt.Sprintf("token_rate_limit:%s:%d", kind, tokenId)
+}
+
+// takeTokenBucket refills the bucket, then takes cost out of it if it holds at least need
+func takeTokenBucket(key string, limit int, need float64, cost float64) (bool, float64) {
+	now := time.Now()
+	if common.RedisEnabled {
+		values, err := tokenBucketScript.Run(context.Background(), common.RDB, []string{key},
+			limit, now.UnixMilli(), need, cost).Slice()
+		if err == nil && len(values) == 2 {
+			allowed, _ := values[0].(int64)
+			tokens, _ := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+			return allowed == 1, tokens
+		}
+		// don't block the traffic because of Redis
+		if err != nil {
+			logger.SysError("Redis token rate limit error: " + err.Error())
+		}
+		return true, float64(limit)
+	}
+	tokenBucketsLock.Lock()
+	defer tokenBucketsLock.Unlock()
+	if now.Sub(tokenBucketsSweptAt) >= time.Minute {
+		sweepTokenBuckets(now)
+	}
+	bucket, ok := tokenBuckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit), updatedAt: now}
+		tokenBuckets[key] = bucket
+	}
+	// the limit of the token may have been changed
+	bucket.limit = limit
+	bucket.refill(now)
+	if bucket.tokens < need {
+		return false, bucket.tokens
+	}
+	bucket.tokens -= cost
+	return true, bucket.tokens
+}
+
+func newTokenRateLimit(allowed bool, limit int, tokens float64, need float64) *TokenRateLimit {
+	perToken := time.Minute / time.Duration(limit)
+	rateLimit := &TokenRateLimit{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: max(0, int(tokens)),
+		Reset:     time.Duration(math.Ceil((float64(limit) - tokens) * float64(perToken))),
+	}
+	if !allowed {
+		rateLimit.RetryAfter = time.Duration(math.Ceil((need - tokens) * float64(perToken)))
+	}
+	return rateLimit
+}
+
+// TakeTokenRequest counts a request against the requests per minute of the token, nil means unlimited
+func TakeTokenRequest(tokenId int, rpm int) *TokenRateLimit {
+	if rpm <= 0 {
+		return nil
+	}
+	allowed, tokens := takeTokenBucket(tokenBucketKey("requests", tokenId), rpm, 1, 1)
+	return newTokenRateLimit(allowed, rpm, tokens, 1)
+}
+
+// CheckTokenTokens reports whether the token has tokens per minute left. The usage isn't known
+// before the response, so nothing is taken here, ConsumeTokenTokens reconciles it afterwards.
+func CheckTokenTokens(tokenId int, tpm int) *TokenRateLimit {
+	if tpm <= 0 {
+		return nil
+	}
+	allowed, tokens := takeTokenBucket(tokenBucketKey("tokens", tokenId), tpm, 1, 0)
+	return newTokenRateLimit(allowed, tpm, tokens, 1)
+}
+
+// ConsumeTokenTokens takes the actual usage out of the tokens per minute of the token,
+// the bucket may go below zero and then blocks the token until it's refilled
+func ConsumeTokenTokens(tokenId int, tpm int, tokens int) {
+	if tpm <= 0 || tokens <= 0 {
+		return
+	}
+	takeTokenBucket(tokenBucketKey("tokens", tokenId), tpm, -math.MaxFloat64, float64(tokens))
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"github.com/eloxt/llmhub/common"
+	"testing"
+	"time"
+)
+
+func TestTakeTokenBucket(t *testing.T) {
+	common.RedisEnabled = false
+	key := tokenBucketKey("requests", -1)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := takeTokenBucket(key, 3, 1, 1); !allowed {
+			t.Fatalf("request %d was rejected within the limit", i+1)
+		}
+	}
+	allowed, tokens := takeTokenBucket(key, 3, 1, 1)
+	if allowed {
+		t.Fatalf("request over the limit was allowed")
+	}
+	rateLimit := newTokenRateLimit(allowed, 3, tokens, 1)
+	if rateLimit.Remaining != 0 || rateLimit.RetryAfter <= 0 || rateLimit.RetryAfter > 20*time.Second {
+		t.Errorf("rate limit = %+v, want no remaining and a retry within 20s", rateLimit)
+	}
+
+	// the bucket refills limit tokens per minute
+	tokenBucketsLock.Lock()
+	tokenBuckets[key].updatedAt = tokenBuckets[key].updatedAt.Add(-20 * time.Second)
+	tokenBucketsLock.Unlock()
+	if allowed, _ := takeTokenBucket(key, 3, 1, 1); !allowed {
+		t.Errorf("request was rejected after the bucket refilled")
+	}
+}
+
+func TestSweepTokenBuckets(t *testing.T) {
+	now := time.Now()
+	tokenBucketsLock.Lock()
+	defer tokenBucketsLock.Unlock()
+	tokenBuckets["full"] = &tokenBucket{tokens: 10, limit: 10, updatedAt: now}
+	tokenBuckets["refilled"] = &tokenBucket{tokens: 0, limit: 10, updatedAt: now.Add(-time.Minute)}
+	tokenBuckets["empty"] = &tokenBucket{tokens: 0, limit: 10, updatedAt: now}
+	sweepTokenBuckets(now)
+	for key, want := range map[string]bool{"full": false, "refilled": false, "empty": true} {
+		if _, ok := tokenBuckets[key]; ok != want {
+			t.Errorf("bucket %s kept = %v, want %v", key, ok, want)
+		}
+	}
+	delete(tokenBuckets, "empty")
+}
@@ -0,0 +1,193 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/logger"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// token_quota:<id> mirrors the remain quota of the database, including the reservations of the requests in flight.
+// -1 means the key is missing and has to be loaded.
+var reserveTokenQuotaScript = redis.NewScript(`
+local remain = redis.call("GET", KEYS[1])
+if not remain then
+	return -1
+end
+if tonumber(remain) < tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("INCRBYFLOAT", KEYS[1], -tonumber(ARGV[1]))
+return 1
+`)
+
+var adjustTokenQuotaScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("INCRBYFLOAT", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func tokenQuotaKey(tokenId int) string {
+	return fmt.Sprintf("token_quota:%d", tokenId)
+}
+
+func formatQuota(quota float64) string {
+	return strconv.FormatFloat(quota, 'f', -1, 64)
+}
+
+// reserveTokenQuotaDB takes the quota out of the remain quota, only when it covers it if check is set
+func reserveTokenQuotaDB(tokenId int, quota float64, check bool) (bool, error) {
+	tx := DB.Model(&Token{}).Where("id = ?", tokenId)
+	if check {
+		tx = tx.Where("remain_quota >= ?", quota)
+	}
+	result := tx.Update("remain_quota", gorm.Expr("remain_quota - ?", quota))
+	return result.RowsAffected == 1, result.Error
+}
+
+func reserveTokenQuotaRedis(ctx context.Context, tokenId int, quota float64) (bool, error) {
+	key := tokenQuotaKey(tokenId)
+	for i := 0; i < 2; i++ {
+		result, err := reserveTokenQuotaScript.Run(ctx, common.RDB, []string{key}, formatQuota(quota)).Int()
+		if err != nil {
+			return false, err
+		}
+		if result != -1 {
+			return result == 1, nil
+		}
+		var token Token
+		err = DB.Select("remain_quota").First(&token, "id = ?", tokenId).Error
+		if err != nil {
+			return false, err
+		}
+		err = common.RDB.SetNX(ctx, key, formatQuota(token.RemainQuota), time.Duration(TokenCacheSeconds)*time.Second).Err()
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, errors.New("failed to load the token quota into Redis")
+}
+
+// adjustCachedTokenQuota applies a change of the remain quota to Redis, a missing key is loaded again on the next reservation
+func adjustCachedTokenQuota(tokenId int, delta float64) {
+	if !common.RedisEnabled || delta == 0 {
+		return
+	}
+	err := adjustTokenQuotaScript.Run(context.Background(), common.RDB, []string{tokenQuotaKey(tokenId)}, formatQuota(delta)).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logger.SysError("Redis adjust token quota error: " + err.Error())
+		// better load it again than let it drift
+		_ = common.RedisDel(tokenQuotaKey(tokenId))
+	}
+}
+
+// invalidateCachedTokenQuota is needed whenever the remain quota is set rather than changed by a delta
+func invalidateCachedTokenQuota(tokenId int) {
+	if !common.RedisEnabled {
+		return
+	}
+	err := common.RedisDel(tokenQuotaKey(tokenId))
+	if err != nil {
+		logger.SysError("Redis delete token quota error: " + err.Error())
+	}
+}
+
+func reserveTokenRemainQuota(ctx context.Context, tokenId int, quota float64, unlimited bool) (bool, error) {
+	if quota <= 0 {
+		return true, nil
+	}
+	if unlimited {
+		// nothing to check, the remain quota is taken the same so the settlement is alike
+		_, err := reserveTokenQuotaDB(tokenId, quota, false)
+		if err != nil {
+			return false, err
+		}
+		adjustCachedTokenQuota(tokenId, -quota)
+		return true, nil
+	}
+	if !common.RedisEnabled {
+		return reserveTokenQuotaDB(tokenId, quota, true)
+	}
+	ok, err := reserveTokenQuotaRedis(ctx, tokenId, quota)
+	if err != nil {
+		logger.Error(ctx, "Redis reserve token quota error: "+err.Error())
+		return reserveTokenQuotaDB(tokenId, quota, true)
+	}
+	if !ok {
+		return false, nil
+	}
+	// Redis has checked the quota, the database only follows it
+	_, err = reserveTokenQuotaDB(tokenId, quota, false)
+	if err != nil {
+		adjustCachedTokenQuota(tokenId, quota)
+		return false, err
+	}
+	return true, nil
+}
+
+// ReserveTokenQuota takes the estimated cost of a request out of the remain quota of a token before it is sent,
+// and adds it to the spend of the budgets of the token and its ancestors. False means the remain quota doesn't cover it,
+// ErrTokenBudgetExhausted is returned when a budget doesn't. The reservation must be settled by SettleTokenQuota
+// or given back by ReleaseTokenQuota.
+func ReserveTokenQuota(ctx context.Context, tokenId int, quota float64, unlimited bool) (bool, error) {
+	quota = max(quota, 0)
+	budgetIds, err := reserveTokenBudgets(tokenId, quota)
+	if err != nil {
+		return false, err
+	}
+	ok, err := reserveTokenRemainQuota(ctx, tokenId, quota, unlimited)
+	if err != nil || !ok {
+		releaseTokenBudgets(budgetIds, quota)
+	}
+	return ok, err
+}
+
+// ReleaseTokenQuota gives a reservation back, it never goes through the batch update
+// because the reservation didn't either
+func ReleaseTokenQuota(tokenId int, quota float64) error {
+	if quota <= 0 {
+		return nil
+	}
+	err := DB.Model(&Token{}).Where("id = ?", tokenId).Update("remain_quota", gorm.Expr("remain_quota + ?", quota)).Error
+	if err != nil {
+		return err
+	}
+	adjustCachedTokenQuota(tokenId, quota)
+	ancestorIds, err := getTokenAncestorIds(tokenId)
+	if err != nil {
+		return err
+	}
+	releaseTokenBudgets(append([]int{tokenId}, ancestorIds...), quota)
+	return nil
+}
+
+// SettleTokenQuota replaces the reservation of a request by its actual cost in a single update, which never goes
+// through the batch update, so the reservation is never freed before the cost is taken
+func SettleTokenQuota(tokenId int, reserved float64, quota float64) error {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Token{}).Where("id = ?", tokenId).Updates(
+			map[string]interface{}{
+				"remain_quota":  gorm.Expr("remain_quota - ?", quota-reserved),
+				"used_quota":    gorm.Expr("used_quota + ?", quota),
+				"accessed_time": time.Now(),
+			},
+		).Error
+		if err != nil {
+			return err
+		}
+		// the reservation is already part of the spend of the period
+		return updateTokenPeriodQuota(tx, tokenId, quota-reserved)
+	})
+	if err != nil {
+		return err
+	}
+	adjustCachedTokenQuota(tokenId, reserved-quota)
+	return rollUpTokenQuota(tokenId, quota, quota-reserved)
+}
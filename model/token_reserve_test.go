@@ -0,0 +1,102 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReserveTokenQuotaConcurrently(t *testing.T) {
+	setupTestDB(t)
+	token := createTestToken(t, &Token{Name: "concurrent", RemainQuota: 10})
+
+	var reserved atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := ReserveTokenQuota(context.Background(), token.Id, 1, false)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				reserved.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved.Load() != 10 {
+		t.Errorf("%d reservations taken, want 10", reserved.Load())
+	}
+	if remain := getTestToken(t, token.Id).RemainQuota; remain != 0 {
+		t.Errorf("remain quota = %v, want 0", remain)
+	}
+}
+
+func TestSettleTokenQuota(t *testing.T) {
+	setupTestDB(t)
+	token := createTestToken(t, &Token{Name: "settled", RemainQuota: 10})
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		reserved   float64
+		cost       float64
+		wantRemain float64
+		wantUsed   float64
+	}{
+		{"cheaper than reserved", 4, 3, 7, 3},
+		{"dearer than reserved", 2, 5, 2, 8},
+		{"free", 1, 0, 2, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := ReserveTokenQuota(ctx, token.Id, tt.reserved, false)
+			if err != nil || !ok {
+				t.Fatalf("ReserveTokenQuota() = %v, %v", ok, err)
+			}
+			err = SettleTokenQuota(token.Id, tt.reserved, tt.cost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			settled := getTestToken(t, token.Id)
+			if settled.RemainQuota != tt.wantRemain || settled.UsedQuota != tt.wantUsed {
+				t.Errorf("remain %v and used %v, want %v and %v", settled.RemainQuota, settled.UsedQuota, tt.wantRemain, tt.wantUsed)
+			}
+		})
+	}
+
+	ok, err := ReserveTokenQuota(ctx, token.Id, 3, false)
+	if err != nil || ok {
+		t.Errorf("ReserveTokenQuota() above the remain quota = %v, %v", ok, err)
+	}
+	ok, err = ReserveTokenQuota(ctx, token.Id, 2, false)
+	if err != nil || !ok {
+		t.Fatalf("ReserveTokenQuota() = %v, %v", ok, err)
+	}
+	err = ReleaseTokenQuota(token.Id, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released := getTestToken(t, token.Id); released.RemainQuota != 2 || released.UsedQuota != 8 {
+		t.Errorf("remain %v and used %v after the release, want 2 and 8", released.RemainQuota, released.UsedQuota)
+	}
+}
+
+func TestReserveUnlimitedTokenQuota(t *testing.T) {
+	setupTestDB(t)
+	token := createTestToken(t, &Token{Name: "unlimited", UnlimitedQuota: true})
+	ok, err := ReserveTokenQuota(context.Background(), token.Id, 5, true)
+	if err != nil || !ok {
+		t.Fatalf("ReserveTokenQuota() = %v, %v", ok, err)
+	}
+	err = SettleTokenQuota(token.Id, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settled := getTestToken(t, token.Id); settled.RemainQuota != -3 || settled.UsedQuota != 3 {
+		t.Errorf("remain %v and used %v, want -3 and 3", settled.RemainQuota, settled.UsedQuota)
+	}
+}
@@ -0,0 +1,35 @@
+package model
+
+import "testing"
+
+func TestMatchModelPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"gpt-4o", "gpt-4o", true},
+		{"gpt-4o", "gpt-4o-mini", false},
+		{"*", "anything", true},
+		{"*", "", true},
+		{"gpt-4*", "gpt-4o-mini", true},
+		{"gpt-4*", "gpt-3.5-turbo", false},
+		{"*-mini", "gpt-4o-mini", true},
+		{"*-mini", "gpt-4o", false},
+		{"claude-*-sonnet", "claude-3-5-sonnet", true},
+		{"claude-*-sonnet", "claude-3-5-haiku", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "acb", false},
+		// the prefix and the suffix must not overlap
+		{"ab*ba", "aba", false},
+		{"ab*ba", "abba", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if got := matchModelPattern(tt.pattern, tt.name); got != tt.want {
+				t.Errorf("matchModelPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+			}
+		})
+	}
+}
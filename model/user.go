@@ -8,6 +8,7 @@ import (
 	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/logger"
 	"github.com/eloxt/llmhub/common/random"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -37,6 +38,8 @@ type User struct {
 	AccessToken  string `json:"access_token" gorm:"type:char(32);column:access_token;uniqueIndex"`
 	UsedQuota    int64  `json:"used_quota" gorm:"bigint;default:0;column:used_quota"`
 	RequestCount int    `json:"request_count" gorm:"type:int;default:0;"`
+	// Group is a comma separated list of the groups the user belongs to, the first one is used by default
+	Group string `json:"group" gorm:"type:varchar(255);default:'default'"`
 }
 
 func GetMaxUserId() int {
@@ -120,13 +123,13 @@ func (user *User) Insert(ctx context.Context, inviterId int) error {
 	cleanToken := Token{
 		UserId:         user.Id,
 		Name:           "default",
-		Key:            random.GenerateKey(),
 		CreatedTime:    time.Now(),
 		AccessedTime:   time.Now(),
 		ExpiredTime:    nil,
 		RemainQuota:    -1,
 		UnlimitedQuota: true,
 	}
+	cleanToken.GenerateKey()
 	result.Error = cleanToken.Insert()
 	if result.Error != nil {
 		// do not block
@@ -282,6 +285,36 @@ func GetUserGroup(id int) (group string, err error) {
 	return group, err
 }
 
+// SplitGroups parses a comma separated list of groups
+func SplitGroups(groups string) []string {
+	return splitCommaList(groups)
+}
+
+func splitCommaList(list string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func UpdateUserGroup(id int, group string) error {
+	err := DB.Model(&User{}).Where("id = ?", id).Update("group", group).Error
+	if err != nil {
+		return err
+	}
+	if common.RedisEnabled {
+		err = common.RedisDel(fmt.Sprintf("user_group:%d", id))
+		if err != nil {
+			logger.SysError("Redis delete user group error: " + err.Error())
+		}
+	}
+	return nil
+}
+
 func GetRootUserEmail() (email string) {
 	DB.Model(&User{}).Where("role = ?", RoleRootUser).Select("email").Find(&email)
 	return email
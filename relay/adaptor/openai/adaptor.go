@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/eloxt/llmhub/common/client"
+	"github.com/eloxt/llmhub/common/ctxkey"
 	"github.com/eloxt/llmhub/common/logger"
 	"github.com/eloxt/llmhub/model"
 	"github.com/eloxt/llmhub/relay/adaptor"
@@ -15,6 +16,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -105,10 +107,13 @@ func (a *Adaptor) DoRequest(c *gin.Context, meta *meta.Meta, requestBody io.Read
 
 func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, meta *meta.Meta) (usage *relayModel.Usage, err *relayModel.ErrorWithStatusCode) {
 	if meta.IsStream {
-		var responseText string
-		err, responseText, usage = StreamHandler(c, resp, meta.Mode)
+		var responseText, reasoningText string
+		err, responseText, reasoningText, usage = StreamHandler(c, resp, meta.Mode)
+		if c.GetBool(ctxkey.CaptureResponse) {
+			c.Set(ctxkey.ResponseText, responseText)
+		}
 		if usage == nil || usage.TotalTokens == 0 {
-			usage = ResponseText2Usage(responseText, meta.ActualModelName, meta.PromptTokens)
+			usage = ResponseText2Usage(responseText, reasoningText, meta.ActualModelName, meta.PromptTokens)
 		}
 		if usage.TotalTokens != 0 && usage.PromptTokens == 0 { // some channels don't return prompt tokens & completion tokens
 			usage.PromptTokens = meta.PromptTokens
@@ -181,6 +186,7 @@ func (a *Adaptor) FetchModelList(baseUrl string, key string) ([]*model.Model, er
 			Reasoning:       internalReasoning,
 			Additional:      webSearch,
 			Tokenizer:       m.Architecture.Tokenizer,
+			Capabilities:    getCapabilities(m),
 		}
 		respModel := &model.Model{
 			Id:         id,
@@ -195,6 +201,28 @@ func (a *Adaptor) FetchModelList(baseUrl string, key string) ([]*model.Model, er
 	return modelList, nil
 }
 
+// getCapabilities derives the capabilities from the OpenRouter style model list,
+// returns nil when the provider exposes nothing about them
+func getCapabilities(m ModelList) []string {
+	var capabilities []string
+	if slices.Contains(m.SupportedParameters, "tools") {
+		capabilities = append(capabilities, model.CapabilityTools)
+	}
+	if slices.Contains(m.SupportedParameters, "structured_outputs") {
+		capabilities = append(capabilities, model.CapabilityJSONSchema)
+	}
+	if slices.Contains(m.SupportedParameters, "reasoning") {
+		capabilities = append(capabilities, model.CapabilityReasoning)
+	}
+	if slices.Contains(m.Architecture.InputModalities, "image") {
+		capabilities = append(capabilities, model.CapabilityVision)
+	}
+	if slices.Contains(m.Architecture.InputModalities, "audio") || slices.Contains(m.Architecture.OutputModalities, "audio") {
+		capabilities = append(capabilities, model.CapabilityAudio)
+	}
+	return capabilities
+}
+
 func (a *Adaptor) GetChannelName() string {
 	return ""
 }
@@ -7,10 +7,17 @@ import (
 	"strings"
 )
 
-func ResponseText2Usage(responseText string, modelName string, promptTokens int) *model.Usage {
+// ResponseText2Usage estimates the usage when the upstream does not return it,
+// the reasoning tokens are counted in the completion tokens as the upstreams do
+func ResponseText2Usage(responseText string, reasoningText string, modelName string, promptTokens int) *model.Usage {
 	usage := &model.Usage{}
 	usage.PromptTokens = promptTokens
 	usage.CompletionTokens = CountTokenText(responseText, modelName)
+	if reasoningText != "" {
+		reasoningTokens := CountTokenText(reasoningText, modelName)
+		usage.CompletionTokens += reasoningTokens
+		usage.CompletionTokensDetails = &model.CompletionTokensDetails{ReasoningTokens: reasoningTokens}
+	}
 	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
 	return usage
 }
@@ -4,8 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
 	"github.com/eloxt/llmhub/common/conv"
+	"github.com/eloxt/llmhub/common/ctxkey"
 	"github.com/eloxt/llmhub/common/logger"
 	"github.com/eloxt/llmhub/common/render"
 	"github.com/eloxt/llmhub/relay/model"
@@ -13,6 +17,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -23,13 +29,51 @@ const (
 	dataPrefixLength = len(dataPrefix)
 )
 
-func StreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*model.ErrorWithStatusCode, string, *model.Usage) {
+type streamErrorResponse struct {
+	Error *model.Error `json:"error"`
+}
+
+// StreamHandler relays the upstream stream to the client. Nothing is written until the first meaningful
+// chunk arrives, so a stream which fails before that returns an error and the request can be retried.
+// The reasoning_content deltas are returned apart from the content, to estimate the reasoning tokens.
+func StreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*model.ErrorWithStatusCode, string, string, *model.Usage) {
 	responseText := ""
+	reasoningText := ""
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Split(bufio.ScanLines)
 	var usage *model.Usage
 
-	common.SetEventStreamHeaders(c)
+	var pending []string
+	started := false
+	var timedOut atomic.Bool
+	var idleTimer *time.Timer
+	idleTimeout := time.Duration(config.StreamFirstTokenTimeout) * time.Second
+	if idleTimeout > 0 {
+		idleTimer = time.AfterFunc(idleTimeout, func() {
+			timedOut.Store(true)
+			_ = resp.Body.Close()
+		})
+		// stopped on every return, the first chunk stops it earlier
+		defer idleTimer.Stop()
+	}
+	start := func() {
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+		common.SetEventStreamHeaders(c)
+		for _, data := range pending {
+			render.StringData(c, data)
+		}
+		pending = nil
+		started = true
+	}
+	renderData := func(data string) {
+		if started {
+			render.StringData(c, data)
+		} else {
+			pending = append(pending, data)
+		}
+	}
 
 	doneRendered := false
 	for scanner.Scan() {
@@ -40,48 +84,84 @@ func StreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*model.E
 		if data[:dataPrefixLength] != dataPrefix && data[:dataPrefixLength] != done {
 			continue
 		}
+		if !started && idleTimer != nil {
+			idleTimer.Reset(idleTimeout)
+		}
 		if strings.HasPrefix(data[dataPrefixLength:], done) {
+			if !started {
+				// nothing was sent, the request can still be retried
+				break
+			}
 			render.StringData(c, data)
 			doneRendered = true
 			continue
 		}
+		if !started {
+			var errResponse streamErrorResponse
+			if json.Unmarshal([]byte(data[dataPrefixLength:]), &errResponse) == nil && errResponse.Error != nil && errResponse.Error.Message != "" {
+				_ = resp.Body.Close()
+				return &model.ErrorWithStatusCode{
+					Error:      *errResponse.Error,
+					StatusCode: http.StatusBadGateway,
+				}, "", "", nil
+			}
+		}
 		switch relayMode {
 		case relaymode.ChatCompletions:
 			var streamResponse ChatCompletionsStreamResponse
 			err := json.Unmarshal([]byte(data[dataPrefixLength:]), &streamResponse)
 			if err != nil {
 				logger.SysError("error unmarshalling stream response: " + err.Error())
-				render.StringData(c, data) // if error happened, pass the data to client
-				continue                   // just ignore the error
+				renderData(data) // if error happened, pass the data to client
+				continue         // just ignore the error
 			}
 			if len(streamResponse.Choices) == 0 && streamResponse.Usage == nil {
 				// but for empty choice and no usage, we should not pass it to client, this is for azure
 				continue // just ignore empty choice
 			}
-			render.StringData(c, data)
+			if !started && hasChatContent(&streamResponse) {
+				start()
+			}
+			renderData(data)
 			for _, choice := range streamResponse.Choices {
 				responseText += conv.AsString(choice.Delta.Content)
+				reasoningText += conv.AsString(choice.Delta.ReasoningContent)
 			}
 			if streamResponse.Usage != nil {
 				usage = streamResponse.Usage
 			}
 		case relaymode.Completions:
-			render.StringData(c, data)
 			var streamResponse CompletionsStreamResponse
 			err := json.Unmarshal([]byte(data[dataPrefixLength:]), &streamResponse)
 			if err != nil {
 				logger.SysError("error unmarshalling stream response: " + err.Error())
+				renderData(data)
 				continue
 			}
 			for _, choice := range streamResponse.Choices {
+				if !started && (choice.Text != "" || choice.FinishReason != "") {
+					start()
+				}
 				responseText += choice.Text
 			}
+			renderData(data)
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
+		if !started {
+			_ = resp.Body.Close()
+			if timedOut.Load() {
+				return ErrorWrapper(c, fmt.Errorf("no data from upstream in %s", idleTimeout), "stream_first_token_timeout", http.StatusGatewayTimeout), "", "", nil
+			}
+			return ErrorWrapper(c, err, "read_stream_failed", http.StatusBadGateway), "", "", nil
+		}
 		logger.SysError("error reading stream: " + err.Error())
 	}
+	if !started {
+		_ = resp.Body.Close()
+		return ErrorWrapper(c, errors.New("upstream closed the stream before the first token"), "empty_stream", http.StatusBadGateway), "", "", nil
+	}
 
 	if !doneRendered {
 		render.Done(c)
@@ -89,10 +169,21 @@ func StreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*model.E
 
 	err := resp.Body.Close()
 	if err != nil {
-		return ErrorWrapper(c, err, "close_response_body_failed", http.StatusInternalServerError), "", nil
+		return ErrorWrapper(c, err, "close_response_body_failed", http.StatusInternalServerError), "", "", nil
 	}
 
-	return nil, responseText, usage
+	return nil, responseText, reasoningText, usage
+}
+
+// hasChatContent reports whether the chunk carries anything the client should see
+func hasChatContent(streamResponse *ChatCompletionsStreamResponse) bool {
+	for _, choice := range streamResponse.Choices {
+		if conv.AsString(choice.Delta.Content) != "" || conv.AsString(choice.Delta.ReasoningContent) != "" ||
+			len(choice.Delta.ToolCalls) != 0 || (choice.FinishReason != nil && *choice.FinishReason != "") {
+			return true
+		}
+	}
+	return false
 }
 
 func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
@@ -115,6 +206,13 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName st
 			StatusCode: resp.StatusCode,
 		}, nil
 	}
+	if c.GetBool(ctxkey.CaptureResponse) {
+		responseText := ""
+		for _, choice := range textResponse.Choices {
+			responseText += choice.Message.StringContent()
+		}
+		c.Set(ctxkey.ResponseText, responseText)
+	}
 	// Reset response body
 	resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
 
@@ -136,15 +234,12 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName st
 	}
 
 	if textResponse.Usage.TotalTokens == 0 || (textResponse.Usage.PromptTokens == 0 && textResponse.Usage.CompletionTokens == 0) {
-		completionTokens := 0
+		responseText, reasoningText := "", ""
 		for _, choice := range textResponse.Choices {
-			completionTokens += CountTokenText(choice.Message.StringContent(), modelName)
-		}
-		textResponse.Usage = model.Usage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
+			responseText += choice.Message.StringContent()
+			reasoningText += conv.AsString(choice.Message.ReasoningContent)
 		}
+		textResponse.Usage = *ResponseText2Usage(responseText, reasoningText, modelName, promptTokens)
 	}
 	return nil, &textResponse.Usage
 }
@@ -0,0 +1,111 @@
+package openai
+
+import (
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/relay/relaymode"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newStreamTest(body io.Reader) (*gin.Context, *httptest.ResponseRecorder, *http.Response) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(body)}
+	return c, recorder, resp
+}
+
+func TestStreamHandler(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"content":" world"},"finish_reason":"stop"}]}`,
+		`data: {"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		`data: [DONE]`,
+	}, "\n\n")
+	c, recorder, resp := newStreamTest(strings.NewReader(stream))
+	err, responseText, _, usage := StreamHandler(c, resp, relaymode.ChatCompletions)
+	if err != nil {
+		t.Fatalf("StreamHandler() error = %+v", err)
+	}
+	if responseText != "Hello world" {
+		t.Errorf("response text = %q, want Hello world", responseText)
+	}
+	if usage == nil || usage.TotalTokens != 5 {
+		t.Errorf("usage = %+v, want 5 tokens", usage)
+	}
+	body := recorder.Body.String()
+	// the chunk held back before the first token goes out first
+	role := strings.Index(body, `"role":"assistant"`)
+	hello := strings.Index(body, `"content":"Hello"`)
+	if role < 0 || hello < role || strings.Count(body, "[DONE]") != 1 {
+		t.Errorf("unexpected stream sent to the client:\n%s", body)
+	}
+}
+
+func TestStreamHandlerFailsBeforeFirstToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   string
+		wantCode string
+	}{
+		{
+			"error chunk",
+			`data: {"choices":[{"index":0,"delta":{"role":"assistant"}}]}` + "\n\n" +
+				`data: {"error":{"message":"overloaded","type":"server_error"}}` + "\n\n",
+			"",
+		},
+		{"done without a token", `data: {"choices":[{"index":0,"delta":{"role":"assistant"}}]}` + "\n\ndata: [DONE]\n\n", "empty_stream"},
+		{"closed without a token", `data: {"choices":[{"index":0,"delta":{"role":"assistant"}}]}` + "\n\n", "empty_stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, recorder, resp := newStreamTest(strings.NewReader(tt.stream))
+			err, _, _, _ := StreamHandler(c, resp, relaymode.ChatCompletions)
+			if err == nil {
+				t.Fatalf("StreamHandler() succeeded")
+			}
+			if err.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", err.StatusCode, http.StatusBadGateway)
+			}
+			if tt.wantCode != "" && err.Code != tt.wantCode {
+				t.Errorf("code = %v, want %s", err.Code, tt.wantCode)
+			}
+			// nothing reached the client, so the request can be retried on another channel
+			if c.Writer.Written() || recorder.Body.Len() != 0 {
+				t.Errorf("data sent to the client: %q", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestStreamHandlerFirstTokenTimeout(t *testing.T) {
+	saved := config.StreamFirstTokenTimeout
+	config.StreamFirstTokenTimeout = 1
+	t.Cleanup(func() {
+		config.StreamFirstTokenTimeout = saved
+	})
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	c, recorder, resp := newStreamTest(reader)
+	resp.Body = reader
+
+	start := time.Now()
+	err, _, _, _ := StreamHandler(c, resp, relaymode.ChatCompletions)
+	if err == nil || err.StatusCode != http.StatusGatewayTimeout || err.Code != "stream_first_token_timeout" {
+		t.Fatalf("StreamHandler() error = %+v, want a first token timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("timed out after %s", elapsed)
+	}
+	if recorder.Body.Len() != 0 {
+		t.Errorf("data sent to the client: %q", recorder.Body.String())
+	}
+}
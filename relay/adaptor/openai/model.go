@@ -149,17 +149,20 @@ type ModelListResponse struct {
 }
 
 type ModelList struct {
-	ID            string       `json:"id"`
-	Name          string       `json:"name"`
-	Description   string       `json:"description"`
-	ContextLength int64        `json:"context_length"`
-	Architecture  Architecture `json:"architecture"`
-	Pricing       Pricing      `json:"pricing"`
+	ID                  string       `json:"id"`
+	Name                string       `json:"name"`
+	Description         string       `json:"description"`
+	ContextLength       int64        `json:"context_length"`
+	Architecture        Architecture `json:"architecture"`
+	Pricing             Pricing      `json:"pricing"`
+	SupportedParameters []string     `json:"supported_parameters"`
 }
 
 type Architecture struct {
-	Modality  string `json:"modality"`
-	Tokenizer string `json:"tokenizer"`
+	Modality         string   `json:"modality"`
+	InputModalities  []string `json:"input_modalities"`
+	OutputModalities []string `json:"output_modalities"`
+	Tokenizer        string   `json:"tokenizer"`
 }
 
 type Pricing struct {
@@ -3,27 +3,42 @@ package billing
 import (
 	"github.com/eloxt/llmhub/common/logger"
 	"github.com/eloxt/llmhub/model"
+	"sync"
 )
 
 var channelModelConfig map[int]map[string]*model.Config
+var channelModelConfigLock sync.RWMutex
 
 func Init() {
-	models, err := model.GetModelList()
+	err := Reload()
 	if err != nil {
 		logger.FatalLog("failed to initialize model list: " + err.Error())
-		return
+	}
+}
+
+// Reload reads the model configs again, after their prices have changed
+func Reload() error {
+	models, err := model.GetModelList()
+	if err != nil {
+		return err
 	}
 
-	channelModelConfig = make(map[int]map[string]*model.Config)
+	newChannelModelConfig := make(map[int]map[string]*model.Config)
 	for _, _model := range models {
-		if _, ok := channelModelConfig[_model.ChannelId]; !ok {
-			channelModelConfig[_model.ChannelId] = make(map[string]*model.Config)
+		if _, ok := newChannelModelConfig[_model.ChannelId]; !ok {
+			newChannelModelConfig[_model.ChannelId] = make(map[string]*model.Config)
 		}
-		channelModelConfig[_model.ChannelId][_model.Name] = _model.Config
+		newChannelModelConfig[_model.ChannelId][_model.Name] = _model.Config
 	}
+	channelModelConfigLock.Lock()
+	channelModelConfig = newChannelModelConfig
+	channelModelConfigLock.Unlock()
+	return nil
 }
 
 func GetChannelModelConfig(channelId int, modelId string) (model.Config, bool) {
+	channelModelConfigLock.RLock()
+	defer channelModelConfigLock.RUnlock()
 	if channelModelConfig == nil {
 		return model.Config{}, false
 	}
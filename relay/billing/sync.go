@@ -0,0 +1,81 @@
+package billing
+
+import (
+	"fmt"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay"
+	"github.com/eloxt/llmhub/relay/channeltype"
+	"github.com/eloxt/llmhub/relay/meta"
+	"time"
+)
+
+// SyncChannelPrices fetches the model list of the channel and diffs it against the stored model rows
+func SyncChannelPrices(channel *model.Channel) (*model.PriceSyncResult, error) {
+	adaptorInstance := relay.GetAdaptor(channeltype.ToAPIType(channel.Type))
+	if adaptorInstance == nil {
+		return nil, fmt.Errorf("invalid channel type: %d", channel.Type)
+	}
+	adaptorInstance.Init(&meta.Meta{ChannelType: channel.Type})
+	list, err := adaptorInstance.FetchModelList(channel.GetBaseURL(), channel.Key)
+	if err != nil {
+		return nil, err
+	}
+	// an empty list is more likely a broken upstream than one without any model
+	if len(list) == 0 {
+		return nil, fmt.Errorf("empty model list")
+	}
+	return model.SyncModelPrices(channel.Id, list, config.PriceSyncAutoApply)
+}
+
+// SyncAllChannelPrices syncs every enabled channel, the billing is reloaded when a price has been applied
+func SyncAllChannelPrices() []*model.PriceSyncResult {
+	channels, err := model.GetEnabledChannels()
+	if err != nil {
+		logger.SysError("failed to get the channels to sync prices: " + err.Error())
+		return nil
+	}
+	var results []*model.PriceSyncResult
+	applied := 0
+	for _, channel := range channels {
+		result, err := SyncChannelPrices(channel)
+		if err != nil {
+			logger.SysErrorf("failed to sync the prices of channel #%d: %s", channel.Id, err.Error())
+			continue
+		}
+		if len(result.UpstreamMissing) > 0 {
+			logger.SysLogf("models of channel #%d no longer listed by the upstream: %v", channel.Id, result.UpstreamMissing)
+		}
+		applied += result.Applied
+		results = append(results, result)
+	}
+	if applied > 0 {
+		err = Reload()
+		if err != nil {
+			logger.SysError("failed to reload the billing: " + err.Error())
+		}
+	}
+	return results
+}
+
+func SyncConfigs(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		err := Reload()
+		if err != nil {
+			logger.SysError("failed to reload the billing: " + err.Error())
+		}
+	}
+}
+
+func SyncPrices(frequency int) {
+	if frequency <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		logger.SysLog("syncing model prices")
+		SyncAllChannelPrices()
+	}
+}
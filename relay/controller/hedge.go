@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/middleware"
+	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay"
+	"github.com/eloxt/llmhub/relay/adaptor"
+	"github.com/eloxt/llmhub/relay/billing"
+	"github.com/eloxt/llmhub/relay/meta"
+	relaymodel "github.com/eloxt/llmhub/relay/model"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hedgeAttempt is one of the upstream requests sent for a hedged relay
+type hedgeAttempt struct {
+	c           *gin.Context
+	channel     *model.Channel // nil for the primary attempt
+	meta        *meta.Meta
+	adaptor     adaptor.Adaptor
+	modelConfig model.Config
+	textRequest *relaymodel.GeneralOpenAIRequest
+	resp        *http.Response
+	err         error
+	cancel      context.CancelFunc
+}
+
+type bufferedBody struct {
+	*bufio.Reader
+	io.Closer
+}
+
+func getHedgeDelay(c *gin.Context, modelConfig model.Config) time.Duration {
+	if _, ok := c.Get(ctxkey.SpecificChannelId); ok {
+		return 0
+	}
+	delay := c.GetInt(ctxkey.HedgeDelay)
+	if delay == 0 {
+		delay = modelConfig.HedgeDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+func (attempt *hedgeAttempt) succeeded() bool {
+	return attempt.err == nil && !isErrorHappened(attempt.meta, attempt.resp)
+}
+
+func (attempt *hedgeAttempt) discard() {
+	attempt.cancel()
+	if attempt.resp != nil {
+		_ = attempt.resp.Body.Close()
+	}
+}
+
+func (attempt *hedgeAttempt) do(requestBody io.Reader, results chan<- *hedgeAttempt) {
+	attempt.resp, attempt.err = doRequest(attempt.c, attempt.meta, attempt.adaptor, requestBody)
+	if attempt.succeeded() {
+		// wait for the first byte, so a channel which accepted the request but is stuck loses
+		reader := bufio.NewReader(attempt.resp.Body)
+		_, err := reader.Peek(1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			_ = attempt.resp.Body.Close()
+			attempt.resp, attempt.err = nil, err
+		} else {
+			attempt.resp.Body = bufferedBody{Reader: reader, Closer: attempt.resp.Body}
+		}
+	}
+	results <- attempt
+}
+
+// doHedgedRequest sends the request to the primary channel, and to a second one if the primary
+// hasn't produced the first byte within the delay. The first successful response wins and the other
+// one is cancelled. The returned attempt is the winner, or the failed primary if both failed.
+// The caller must cancel the returned attempt once the response is consumed.
+func doHedgedRequest(c *gin.Context, primary *hedgeAttempt, requestBody io.Reader, delay time.Duration) *hedgeAttempt {
+	ctx := c.Request.Context()
+	primaryCtx, cancel := context.WithCancel(ctx)
+	primary.c = c.Copy()
+	primary.c.Request = c.Request.WithContext(primaryCtx)
+	primary.cancel = cancel
+
+	results := make(chan *hedgeAttempt, 2)
+	go primary.do(requestBody, results)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var secondary, failed *hedgeAttempt
+	pending := 1
+	for pending > 0 {
+		select {
+		case attempt := <-results:
+			pending--
+			if attempt.succeeded() {
+				other := primary
+				if attempt == primary {
+					other = secondary
+				}
+				if other != nil {
+					other.cancel()
+					if pending > 0 {
+						go func() {
+							(<-results).discard()
+						}()
+					} else if other.resp != nil {
+						_ = other.resp.Body.Close()
+					}
+					attempt.meta.Hedged = true
+					attempt.meta.HedgeWon = attempt == secondary
+					logger.Infof(ctx, "hedged request won by channel #%d, primary channel #%d", attempt.meta.ChannelId, primary.meta.ChannelId)
+				}
+				return attempt
+			}
+			if secondary == nil {
+				// failed before hedging, let the retry logic deal with it
+				return attempt
+			}
+			if failed == nil {
+				failed = attempt
+			} else if attempt == primary {
+				failed.discard()
+				failed = attempt
+			} else {
+				attempt.discard()
+			}
+		case <-timer.C:
+			secondary = newHedgeAttempt(c, primary)
+			if secondary == nil {
+				continue
+			}
+			logger.Infof(ctx, "no first byte from channel #%d after %s, hedging with channel #%d", primary.meta.ChannelId, delay, secondary.meta.ChannelId)
+			body, err := getRequestBody(secondary.c, secondary.meta, secondary.textRequest, secondary.adaptor)
+			if err != nil {
+				logger.Errorf(ctx, "failed to get hedged request body: %s", err.Error())
+				secondary.cancel()
+				secondary = nil
+				continue
+			}
+			pending++
+			go secondary.do(body, results)
+		}
+	}
+	failed.meta.Hedged = true
+	return failed
+}
+
+// newHedgeAttempt prepares a request to another channel serving the same model, nil if there is none
+func newHedgeAttempt(c *gin.Context, primary *hedgeAttempt) *hedgeAttempt {
+	ctx := c.Request.Context()
+	originalModel := c.GetString(ctxkey.OriginalModel)
+	capabilities := c.GetStringSlice(ctxkey.Capabilities)
+	var channel *model.Channel
+	for i := 0; i < 3; i++ {
+		candidate, err := model.CacheGetRandomSatisfiedChannel(c.GetString(ctxkey.Group), originalModel, i > 0, capabilities)
+		if err != nil {
+			break
+		}
+		if candidate.Id != primary.meta.ChannelId {
+			channel = candidate
+			break
+		}
+	}
+	if channel == nil {
+		logger.Infof(ctx, "no other channel to hedge model %s", originalModel)
+		return nil
+	}
+
+	// the hedged request never waits for a busy channel
+	release, ok := model.TryAcquireChannel(channel.Id, channel.GetMaxConcurrency())
+	if !ok {
+		logger.Infof(ctx, "channel #%d is saturated, not hedging", channel.Id)
+		return nil
+	}
+	hedgeCtx, cancelCtx := context.WithCancel(ctx)
+	var once sync.Once
+	cancel := func() {
+		cancelCtx()
+		once.Do(release)
+	}
+	hedgeContext := c.Copy()
+	hedgeContext.Request = c.Request.Clone(hedgeCtx)
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		cancel()
+		return nil
+	}
+	hedgeContext.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	hedgeContext.Set(ctxkey.SystemPrompt, "")
+	middleware.SetupContextForSelectedChannel(hedgeContext, channel, originalModel)
+
+	hedgeMeta := meta.GetByContext(hedgeContext)
+	hedgeMeta.IsStream = primary.meta.IsStream
+	hedgeMeta.OriginModelName = primary.meta.OriginModelName
+	hedgeMeta.PromptTokens = primary.meta.PromptTokens
+	hedgeMeta.StartTime = primary.meta.StartTime
+	modelConfig, ok := billing.GetChannelModelConfig(channel.Id, hedgeMeta.OriginModelName)
+	if !ok {
+		cancel()
+		return nil
+	}
+	adaptorInstance := relay.GetAdaptor(hedgeMeta.APIType)
+	if adaptorInstance == nil {
+		cancel()
+		return nil
+	}
+	adaptorInstance.Init(hedgeMeta)
+	textRequest := *primary.textRequest
+	textRequest.Model, _ = getMappedModelName(hedgeMeta.OriginModelName, hedgeMeta.ModelMapping)
+	hedgeMeta.ActualModelName = textRequest.Model
+	return &hedgeAttempt{
+		c:           hedgeContext,
+		channel:     channel,
+		meta:        hedgeMeta,
+		adaptor:     adaptorInstance,
+		modelConfig: modelConfig,
+		textRequest: &textRequest,
+		cancel:      cancel,
+	}
+}
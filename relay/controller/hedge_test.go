@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"bytes"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/client"
+	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/middleware"
+	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay"
+	"github.com/eloxt/llmhub/relay/billing"
+	"github.com/eloxt/llmhub/relay/channeltype"
+	"github.com/eloxt/llmhub/relay/meta"
+	relaymodel "github.com/eloxt/llmhub/relay/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const hedgeTestRequest = `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	common.RedisEnabled = false
+	client.HTTPClient = &http.Client{}
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	model.DB = db
+	err = db.AutoMigrate(&model.Channel{}, &model.Model{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sqlDB.Close()
+	})
+}
+
+// createTestChannel adds an OpenAI channel for gpt-4o in front of the handler
+func createTestChannel(t *testing.T, name string, priority int64, handler http.HandlerFunc) *model.Channel {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	baseURL := server.URL
+	channel := &model.Channel{
+		Name:    name,
+		Type:    channeltype.OpenAI,
+		Key:     "sk-" + name,
+		Status:  model.ChannelStatusEnabled,
+		BaseURL: &baseURL,
+		Groups:  "default",
+		Models: []*model.Model{
+			{Name: "gpt-4o", MappedName: "gpt-4o", Priority: &priority, Config: &model.Config{Prompt: 1, Completion: 1}},
+		},
+	}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return channel
+}
+
+func respondOK(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"choices":[]}`))
+}
+
+// newHedgeTestContext sets up the context of a request distributed to the channel
+func newHedgeTestContext(t *testing.T, channel *model.Channel) (*gin.Context, *hedgeAttempt) {
+	t.Helper()
+	err := billing.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(hedgeTestRequest))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set(ctxkey.Group, "default")
+	c.Set(ctxkey.RequestModel, "gpt-4o")
+	middleware.SetupContextForSelectedChannel(c, channel, "gpt-4o")
+	primaryMeta := meta.GetByContext(c)
+	primaryMeta.ActualModelName = primaryMeta.OriginModelName
+	adaptorInstance := relay.GetAdaptor(primaryMeta.APIType)
+	adaptorInstance.Init(primaryMeta)
+	modelConfig, _ := billing.GetChannelModelConfig(channel.Id, "gpt-4o")
+	return c, &hedgeAttempt{
+		meta:        primaryMeta,
+		adaptor:     adaptorInstance,
+		modelConfig: modelConfig,
+		textRequest: &relaymodel.GeneralOpenAIRequest{Model: "gpt-4o"},
+	}
+}
+
+func TestGetHedgeDelay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		modelDelay int
+		tokenDelay int
+		specific   bool
+		wantDelay  time.Duration
+	}{
+		{"disabled", 0, 0, false, 0},
+		{"model", 300, 0, false, 300 * time.Millisecond},
+		{"token overrides the model", 300, 100, false, 100 * time.Millisecond},
+		{"token disables it", 300, -1, false, 0},
+		{"never for a specific channel", 300, 100, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			if tt.tokenDelay != 0 {
+				c.Set(ctxkey.HedgeDelay, tt.tokenDelay)
+			}
+			if tt.specific {
+				c.Set(ctxkey.SpecificChannelId, 1)
+			}
+			if got := getHedgeDelay(c, model.Config{HedgeDelay: tt.modelDelay}); got != tt.wantDelay {
+				t.Errorf("getHedgeDelay() = %s, want %s", got, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestDoHedgedRequest(t *testing.T) {
+	setupTestDB(t)
+	cancelled := make(chan struct{})
+	slow := createTestChannel(t, "slow", 0, func(w http.ResponseWriter, r *http.Request) {
+		// the server notices the closed connection once the body is read
+		_, _ = io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			respondOK(w, r)
+		}
+	})
+	fast := createTestChannel(t, "fast", 10, respondOK)
+
+	c, primary := newHedgeTestContext(t, slow)
+	winner := doHedgedRequest(c, primary, bytes.NewBufferString(hedgeTestRequest), 50*time.Millisecond)
+	defer winner.cancel()
+	if winner.err != nil || winner.channel == nil || winner.channel.Id != fast.Id {
+		t.Fatalf("winner = channel %v, error %v, want the fast channel", winner.channel, winner.err)
+	}
+	if !winner.meta.Hedged || !winner.meta.HedgeWon || winner.meta.ChannelId != fast.Id {
+		t.Errorf("meta of the winner: hedged %v, won %v, channel #%d", winner.meta.Hedged, winner.meta.HedgeWon, winner.meta.ChannelId)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("the request to the slow channel wasn't cancelled")
+	}
+}
+
+func TestDoHedgedRequestPrimaryInTime(t *testing.T) {
+	setupTestDB(t)
+	var hedged atomic.Bool
+	primaryChannel := createTestChannel(t, "primary", 0, respondOK)
+	createTestChannel(t, "other", 10, func(w http.ResponseWriter, r *http.Request) {
+		hedged.Store(true)
+		respondOK(w, r)
+	})
+
+	c, primary := newHedgeTestContext(t, primaryChannel)
+	winner := doHedgedRequest(c, primary, bytes.NewBufferString(hedgeTestRequest), time.Second)
+	defer winner.cancel()
+	if winner != primary || winner.err != nil || winner.meta.Hedged {
+		t.Errorf("winner = channel #%d, hedged %v, error %v, want the primary", winner.meta.ChannelId, winner.meta.Hedged, winner.err)
+	}
+	if hedged.Load() {
+		t.Errorf("hedged although the primary answered in time")
+	}
+}
+
+func TestDoHedgedRequestPrimaryFailed(t *testing.T) {
+	setupTestDB(t)
+	primaryChannel := createTestChannel(t, "primary", 0, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	createTestChannel(t, "other", 10, respondOK)
+
+	// a failure before the delay is left to the retry logic
+	c, primary := newHedgeTestContext(t, primaryChannel)
+	winner := doHedgedRequest(c, primary, bytes.NewBufferString(hedgeTestRequest), time.Second)
+	defer winner.cancel()
+	if winner != primary || winner.succeeded() || winner.meta.Hedged {
+		t.Errorf("winner = channel #%d, hedged %v, want the failed primary", winner.meta.ChannelId, winner.meta.Hedged)
+	}
+	_ = winner.resp.Body.Close()
+}
@@ -17,6 +17,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"math"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func getAndValidateTextRequest(c *gin.Context, relayMode int) (*relaymodel.GeneralOpenAIRequest, error) {
@@ -50,10 +52,17 @@ func getPromptTokens(textRequest *relaymodel.GeneralOpenAIRequest, relayMode int
 	return 0
 }
 
-func getPreConsumedQuota(textRequest *relaymodel.GeneralOpenAIRequest, promptTokens int, inputPrice float64) float64 {
-	preConsumedPrice := config.PreConsumedQuota + float64(promptTokens)*inputPrice
-	if textRequest.MaxTokens != 0 {
-		preConsumedPrice += float64(textRequest.MaxTokens) * inputPrice
+// getPreConsumedQuota estimates the most a request may cost, the completion is priced at the higher
+// of the completion and reasoning prices since the reasoning tokens are part of it
+func getPreConsumedQuota(textRequest *relaymodel.GeneralOpenAIRequest, promptTokens int, modelConfig model.Config) float64 {
+	modelConfig, _ = modelConfig.GetTier(promptTokens, time.Now())
+	preConsumedPrice := config.PreConsumedQuota + float64(promptTokens)*modelConfig.Prompt
+	maxTokens := textRequest.MaxTokens
+	if textRequest.MaxCompletionTokens != nil {
+		maxTokens = *textRequest.MaxCompletionTokens
+	}
+	if maxTokens > 0 {
+		preConsumedPrice += float64(maxTokens) * max(modelConfig.Completion, modelConfig.GetReasoningPrice())
 	}
 	return preConsumedPrice
 }
@@ -62,34 +71,42 @@ func returnPreConsumedQuota(ctx context.Context, preConsumedQuota float64, token
 	if preConsumedQuota != 0 {
 		go func(ctx context.Context) {
 			// return pre-consumed quota
-			err := model.PostConsumeTokenQuota(tokenId, -preConsumedQuota)
+			err := model.ReleaseTokenQuota(tokenId, preConsumedQuota)
 			if err != nil {
 				logger.Error(ctx, "error return pre-consumed quota: "+err.Error())
 			}
-		}(ctx)
+		}(context.WithoutCancel(ctx))
 	}
 }
 
-func postConsumeQuota(ctx context.Context, usage *relaymodel.Usage, meta *meta.Meta, textRequest *relaymodel.GeneralOpenAIRequest, modelConfig model.Config, systemPromptReset bool) {
+// calculateQuota prices the usage by the tier of the model config which matches it
+func calculateQuota(usage *relaymodel.Usage, modelConfig model.Config) float64 {
+	b := usage.Breakdown()
+	modelConfig, _ = modelConfig.GetTier(b.PromptTokens(), time.Now())
+	return float64(b.UncachedTokens)*modelConfig.Prompt +
+		float64(b.CacheReadTokens)*modelConfig.InputCacheRead +
+		float64(b.CacheWriteTokens)*modelConfig.GetCacheWritePrice() +
+		float64(b.CompletionTokens-b.ReasoningTokens)*modelConfig.Completion +
+		float64(b.ReasoningTokens)*modelConfig.GetReasoningPrice()
+}
+
+func postConsumeQuota(ctx context.Context, usage *relaymodel.Usage, meta *meta.Meta, textRequest *relaymodel.GeneralOpenAIRequest, modelConfig model.Config, systemPromptReset bool, preConsumedQuota float64) {
 	if usage == nil {
 		logger.Error(ctx, "usage is nil, which is unexpected")
+		returnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
 		return
 	}
+	b := usage.Breakdown()
+	modelConfig, tier := modelConfig.GetTier(b.PromptTokens(), time.Now())
 	promptPrice := modelConfig.Prompt
-	cachePrice := modelConfig.InputCacheRead
+	cacheReadPrice := modelConfig.InputCacheRead
+	cacheWritePrice := modelConfig.GetCacheWritePrice()
 	completionPrice := modelConfig.Completion
-	promptTokens := usage.PromptTokens
-	completionTokens := usage.CompletionTokens
-
-	var quota float64
-	if usage.PromptTokensDetails != nil && usage.PromptTokensDetails.CachedTokens > 0 {
-		missToken := promptTokens - usage.PromptTokensDetails.CachedTokens
-		quota = float64(missToken)*promptPrice + float64(usage.PromptTokensDetails.CachedTokens)*cachePrice + float64(completionTokens)*completionPrice
-	} else {
-		quota = float64(promptTokens)*promptPrice + float64(completionTokens)*completionPrice
-	}
+	reasoningPrice := modelConfig.GetReasoningPrice()
+	quota := calculateQuota(usage, modelConfig)
 
-	err := model.PostConsumeTokenQuota(meta.TokenId, quota)
+	model.ConsumeTokenTokens(meta.TokenId, meta.TokenTPM, b.PromptTokens()+b.CompletionTokens)
+	err := model.SettleTokenQuota(meta.TokenId, preConsumedQuota, quota)
 	if err != nil {
 		logger.Error(ctx, "error consuming token remain quota: "+err.Error())
 	}
@@ -97,19 +114,31 @@ func postConsumeQuota(ctx context.Context, usage *relaymodel.Usage, meta *meta.M
 	if err != nil {
 		logger.Error(ctx, "error update user quota cache: "+err.Error())
 	}
-	logContent := fmt.Sprintf("Prompt: %.2f, Cached: %.2f, Completion: %.2f", promptPrice*common.Million, cachePrice*common.Million, completionPrice*common.Million)
+	logContent := fmt.Sprintf("Prompt: %.2f, Cache read: %.2f, Cache write: %.2f, Completion: %.2f, Reasoning: %.2f",
+		promptPrice*common.Million, cacheReadPrice*common.Million, cacheWritePrice*common.Million, completionPrice*common.Million, reasoningPrice*common.Million)
 	model.RecordConsumeLog(ctx, &model.Log{
 		UserId:            meta.UserId,
 		ChannelId:         meta.ChannelId,
-		PromptTokens:      promptTokens,
-		CompletionTokens:  completionTokens,
+		PromptTokens:      b.PromptTokens(),
+		CompletionTokens:  b.CompletionTokens,
+		UncachedTokens:    b.UncachedTokens,
+		CachedTokens:      b.CacheReadTokens,
+		CacheWriteTokens:  b.CacheWriteTokens,
+		ReasoningTokens:   b.ReasoningTokens,
 		ModelName:         textRequest.Model,
+		ModelAlias:        meta.ModelAlias,
 		TokenName:         meta.TokenName,
 		Quota:             quota,
 		Content:           logContent,
 		IsStream:          meta.IsStream,
 		ElapsedTime:       helper.CalcElapsedTime(meta.StartTime),
 		SystemPromptReset: systemPromptReset,
+		Hedged:            meta.Hedged,
+		HedgeWon:          meta.HedgeWon,
+		KeyGeneration:     meta.KeyGeneration,
+		ParamRules:        strings.Join(meta.ParamRules, ","),
+		PricingTier:       tier,
+		Tags:              meta.Tags,
 	})
 	model.UpdateUserUsedQuotaAndRequestCount(meta.UserId, quota)
 	model.UpdateChannelUsedQuota(meta.ChannelId, quota)
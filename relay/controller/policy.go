@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/model"
+	relaymodel "github.com/eloxt/llmhub/relay/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getParamPolicies(c *gin.Context) []model.ParamPolicy {
+	policies := make([]model.ParamPolicy, 0, 2)
+	for _, key := range []string{ctxkey.TokenParamPolicy, ctxkey.ChannelParamPolicy} {
+		if policy, ok := c.Get(key); ok && policy != nil {
+			if policy, ok := policy.(model.ParamPolicy); ok && len(policy) > 0 {
+				policies = append(policies, policy)
+			}
+		}
+	}
+	return policies
+}
+
+// applyParamPolicies applies the policies of the token and then of the channel to the request,
+// it returns the rules which fired. The request is only touched when one of them did.
+func applyParamPolicies(c *gin.Context, textRequest *relaymodel.GeneralOpenAIRequest) ([]string, error) {
+	policies := getParamPolicies(c)
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	jsonBytes, err := json.Marshal(textRequest)
+	if err != nil {
+		return nil, err
+	}
+	request := make(map[string]any)
+	err = json.Unmarshal(jsonBytes, &request)
+	if err != nil {
+		return nil, err
+	}
+	fired := make([]string, 0)
+	for _, policy := range policies {
+		rules, err := policy.Apply(request)
+		fired = append(fired, rules...)
+		if err != nil {
+			return fired, err
+		}
+	}
+	if len(fired) == 0 {
+		return nil, nil
+	}
+	jsonBytes, err = json.Marshal(request)
+	if err != nil {
+		return fired, err
+	}
+	*textRequest = relaymodel.GeneralOpenAIRequest{}
+	return fired, json.Unmarshal(jsonBytes, textRequest)
+}
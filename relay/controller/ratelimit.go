@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay/adaptor"
+	"github.com/eloxt/llmhub/relay/meta"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseResetTime understands the formats used by the upstreams for Retry-After and x-ratelimit-reset-*:
+// a duration like "6m0s" or "20ms", a number of seconds, a unix timestamp, an RFC 3339 or an HTTP date.
+func parseResetTime(value string, now time.Time) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(duration), true
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		// a unix timestamp rather than a delay
+		if seconds > 1e9 {
+			return time.Unix(int64(seconds), 0), true
+		}
+		return now.Add(time.Duration(seconds * float64(time.Second))), true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func parseRemaining(value string) int {
+	remaining, err := strconv.Atoi(value)
+	if err != nil {
+		return -1
+	}
+	return remaining
+}
+
+// recordRateLimit saves the rate limit headers of the upstream response, and puts the channel
+// into cooldown for the model when the upstream rejected the request with 429
+func recordRateLimit(ctx context.Context, meta *meta.Meta, resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	now := time.Now()
+	header := resp.Header
+	remainingRequests := parseRemaining(header.Get("x-ratelimit-remaining-requests"))
+	remainingTokens := parseRemaining(header.Get("x-ratelimit-remaining-tokens"))
+	requestsResetAt, _ := parseResetTime(header.Get("x-ratelimit-reset-requests"), now)
+	tokensResetAt, _ := parseResetTime(header.Get("x-ratelimit-reset-tokens"), now)
+	if remainingRequests >= 0 || remainingTokens >= 0 {
+		model.RecordChannelRateLimit(meta.ChannelId, meta.OriginModelName, remainingRequests, requestsResetAt, remainingTokens, tokensResetAt)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	var until time.Time
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil {
+		until = now.Add(time.Duration(ms * float64(time.Millisecond)))
+	} else if retryAfter, ok := parseResetTime(header.Get("Retry-After"), now); ok {
+		until = retryAfter
+	}
+	// only wait for the limits which are hit, or may be hit when the upstream doesn't say
+	resets := []time.Time{}
+	if resetAt, ok := parseResetTime(header.Get("x-ratelimit-reset"), now); ok {
+		resets = append(resets, resetAt)
+	}
+	if remainingRequests <= 0 {
+		resets = append(resets, requestsResetAt)
+	}
+	if remainingTokens <= 0 {
+		resets = append(resets, tokensResetAt)
+	}
+	for _, resetAt := range resets {
+		if resetAt.After(until) {
+			until = resetAt
+		}
+	}
+	if !until.After(now) {
+		until = now.Add(time.Duration(config.ChannelCooldown) * time.Second)
+	}
+	logger.Warnf(ctx, "channel #%d is rate limited for model %s, cooling down until %s", meta.ChannelId, meta.OriginModelName, until.Format(time.RFC3339))
+	model.SetChannelCooldown(meta.ChannelId, meta.OriginModelName, until)
+}
+
+// doRequest sends the request to the upstream and records its rate limit headers, it is the only place
+// the relay sends a request from, so the hedged attempts and the failed ones are recorded alike
+func doRequest(c *gin.Context, meta *meta.Meta, adaptor adaptor.Adaptor, requestBody io.Reader) (*http.Response, error) {
+	resp, err := adaptor.DoRequest(c, meta, requestBody)
+	recordRateLimit(c.Request.Context(), meta, resp)
+	return resp, err
+}
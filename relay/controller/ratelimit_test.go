@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"context"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay/meta"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseResetTime(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Time
+		wantOk bool
+	}{
+		{"", time.Time{}, false},
+		{"6m0s", now.Add(6 * time.Minute), true},
+		{"20ms", now.Add(20 * time.Millisecond), true},
+		{"30", now.Add(30 * time.Second), true},
+		{"1.5", now.Add(1500 * time.Millisecond), true},
+		{"1792411200", time.Unix(1792411200, 0), true},
+		{"2026-10-19T12:05:00Z", now.Add(5 * time.Minute), true},
+		{"Mon, 19 Oct 2026 12:01:00 GMT", now.Add(time.Minute), true},
+		{"soon", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseResetTime(tt.value, now)
+			if ok != tt.wantOk || !got.Equal(tt.want) {
+				t.Errorf("parseResetTime(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestRecordRateLimit(t *testing.T) {
+	common.RedisEnabled = false
+	tests := []struct {
+		name         string
+		channelId    int
+		status       int
+		header       map[string]string
+		wantCooldown time.Duration // 0 means none
+	}{
+		{"retry after", -311, http.StatusTooManyRequests, map[string]string{"Retry-After": "30"}, 30 * time.Second},
+		{"retry after ms", -312, http.StatusTooManyRequests, map[string]string{"retry-after-ms": "2000", "Retry-After": "30"}, 2 * time.Second},
+		{
+			"the reset of the exhausted limit", -313, http.StatusTooManyRequests,
+			map[string]string{
+				"x-ratelimit-remaining-requests": "5", "x-ratelimit-reset-requests": "1m",
+				"x-ratelimit-remaining-tokens": "0", "x-ratelimit-reset-tokens": "20s",
+			},
+			20 * time.Second,
+		},
+		{"nothing said", -314, http.StatusTooManyRequests, nil, time.Duration(config.ChannelCooldown) * time.Second},
+		{"not limited", -315, http.StatusOK, map[string]string{"x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "1m"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for key, value := range tt.header {
+				resp.Header.Set(key, value)
+			}
+			now := time.Now()
+			recordRateLimit(context.Background(), &meta.Meta{ChannelId: tt.channelId, OriginModelName: "gpt-4o"}, resp)
+			state := model.GetChannelRateLimits(tt.channelId)["gpt-4o"]
+			if tt.wantCooldown == 0 {
+				if state != nil && !state.CooldownUntil.IsZero() {
+					t.Errorf("cooling down until %s", state.CooldownUntil)
+				}
+				return
+			}
+			if state == nil {
+				t.Fatalf("no cooldown recorded")
+			}
+			cooldown := state.CooldownUntil.Sub(now)
+			if cooldown < tt.wantCooldown-time.Second || cooldown > tt.wantCooldown+time.Second {
+				t.Errorf("cooldown = %s, want %s", cooldown, tt.wantCooldown)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eloxt/llmhub/common"
+	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/ctxkey"
+	"github.com/eloxt/llmhub/common/helper"
+	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/middleware"
+	"github.com/eloxt/llmhub/model"
+	"github.com/eloxt/llmhub/relay"
+	"github.com/eloxt/llmhub/relay/billing"
+	"github.com/eloxt/llmhub/relay/meta"
+	relaymodel "github.com/eloxt/llmhub/relay/model"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shadowRequest is what the shadow needs to know about the primary request, copied before the gin context is reused
+type shadowRequest struct {
+	requestBody    []byte
+	requestURLPath string
+	mode           int
+	group          string
+	primary        *model.ShadowLog
+}
+
+func newShadowRequest(c *gin.Context, meta *meta.Meta, usage *relaymodel.Usage, modelConfig model.Config) *shadowRequest {
+	requestBody, _ := common.GetRequestBody(c)
+	primary := &model.ShadowLog{
+		PrimaryModelName:    meta.OriginModelName,
+		PrimaryChannelId:    meta.ChannelId,
+		PrimaryElapsedTime:  helper.CalcElapsedTime(meta.StartTime),
+		PrimaryResponseText: c.GetString(ctxkey.ResponseText),
+	}
+	if usage != nil {
+		primary.PrimaryPromptTokens = usage.PromptTokens
+		primary.PrimaryCompletionTokens = usage.CompletionTokens
+		primary.PrimaryQuota = calculateQuota(usage, modelConfig)
+	}
+	return &shadowRequest{
+		requestBody:    requestBody,
+		requestURLPath: c.Request.URL.String(),
+		mode:           meta.Mode,
+		group:          meta.Group,
+		primary:        primary,
+	}
+}
+
+// sampleShadow returns the shadow of the model if this request is picked for mirroring
+func sampleShadow(ctx context.Context, modelName string) *model.Shadow {
+	if config.ShadowTokenId == 0 {
+		return nil
+	}
+	shadow, err := model.CacheGetShadowByModel(modelName)
+	if err != nil {
+		logger.Errorf(ctx, "failed to get shadow of model %s: %s", modelName, err.Error())
+		return nil
+	}
+	if shadow == nil || !shadow.Enabled || rand.Float64() >= shadow.SampleRate {
+		return nil
+	}
+	return shadow
+}
+
+func getShadowChannel(shadow *model.Shadow, group string, targetModel string, primaryChannelId int) (*model.Channel, error) {
+	if shadow.TargetChannelId != 0 {
+		channel, err := model.GetChannelById(shadow.TargetChannelId, true)
+		if err != nil {
+			return nil, err
+		}
+		if channel.Status != model.ChannelStatusEnabled {
+			return nil, fmt.Errorf("channel #%d is disabled", channel.Id)
+		}
+		return channel, nil
+	}
+	for i := 0; i < 3; i++ {
+		channel, err := model.CacheGetRandomSatisfiedChannel(group, targetModel, i > 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		// mirroring the same model to the same channel tells nothing
+		if channel.Id != primaryChannelId || targetModel != shadow.Model {
+			return channel, nil
+		}
+	}
+	return nil, errors.New("no other channel for the shadow")
+}
+
+// mirrorToShadow sends the request to the shadow and stores the outcome next to the primary one.
+// It's billed to the internal shadow token, and always sent without streaming.
+func mirrorToShadow(ctx context.Context, shadow *model.Shadow, request *shadowRequest) {
+	shadowLog := request.primary
+	shadowLog.ShadowId = shadow.Id
+	shadowLog.RequestId = helper.GetRequestID(ctx)
+	shadowLog.ModelName = shadow.TargetModel
+	if shadowLog.ModelName == "" {
+		shadowLog.ModelName = shadow.Model
+	}
+	defer func() {
+		err := model.RecordShadowLog(shadowLog)
+		if err != nil {
+			logger.Errorf(ctx, "failed to record shadow log: %s", err.Error())
+		}
+	}()
+	fail := func(statusCode int, err error) {
+		logger.Warnf(ctx, "shadow #%d failed: %s", shadow.Id, err.Error())
+		shadowLog.StatusCode = statusCode
+		shadowLog.Error = err.Error()
+	}
+
+	token, err := model.GetTokenById(config.ShadowTokenId)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Errorf("shadow token: %w", err))
+		return
+	}
+	channel, err := getShadowChannel(shadow, request.group, shadowLog.ModelName, shadowLog.PrimaryChannelId)
+	if err != nil {
+		fail(http.StatusServiceUnavailable, err)
+		return
+	}
+	shadowLog.ChannelId = channel.Id
+	// the shadow never waits for a busy channel
+	release, ok := model.TryAcquireChannel(channel.Id, channel.GetMaxConcurrency())
+	if !ok {
+		fail(http.StatusTooManyRequests, model.ErrChannelBusy)
+		return
+	}
+	defer release()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, err = http.NewRequestWithContext(ctx, http.MethodPost, request.requestURLPath, bytes.NewReader(request.requestBody))
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set(ctxkey.Id, token.UserId)
+	c.Set(ctxkey.TokenId, token.Id)
+	c.Set(ctxkey.TokenName, token.Name)
+	c.Set(ctxkey.Group, request.group)
+	c.Set(ctxkey.CaptureResponse, true)
+	middleware.SetupContextForSelectedChannel(c, channel, shadowLog.ModelName)
+
+	shadowMeta := meta.GetByContext(c)
+	shadowMeta.OriginModelName = shadowLog.ModelName
+	modelConfig, ok := billing.GetChannelModelConfig(channel.Id, shadowMeta.OriginModelName)
+	if !ok {
+		fail(http.StatusBadRequest, errors.New("model config not found"))
+		return
+	}
+	adaptorInstance := relay.GetAdaptor(shadowMeta.APIType)
+	if adaptorInstance == nil {
+		fail(http.StatusBadRequest, fmt.Errorf("invalid api type: %d", shadowMeta.APIType))
+		return
+	}
+	adaptorInstance.Init(shadowMeta)
+
+	textRequest := &relaymodel.GeneralOpenAIRequest{}
+	err = json.Unmarshal(request.requestBody, textRequest)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	textRequest.Stream = false
+	textRequest.StreamOptions = nil
+	textRequest.Model, _ = getMappedModelName(shadowMeta.OriginModelName, shadowMeta.ModelMapping)
+	shadowMeta.ActualModelName = textRequest.Model
+	shadowMeta.PromptTokens = getPromptTokens(textRequest, request.mode)
+	convertedRequest, err := adaptorInstance.ConvertRequest(c, request.mode, textRequest)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	jsonData, err := json.Marshal(convertedRequest)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	resp, err := adaptorInstance.DoRequest(c, shadowMeta, bytes.NewBuffer(jsonData))
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	if isErrorHappened(shadowMeta, resp) {
+		relayErr := RelayErrorHandler(resp)
+		fail(relayErr.StatusCode, errors.New(relayErr.Message))
+		return
+	}
+	usage, respErr := adaptorInstance.DoResponse(c, resp, shadowMeta)
+	shadowLog.ElapsedTime = helper.CalcElapsedTime(shadowMeta.StartTime)
+	if respErr != nil {
+		fail(respErr.StatusCode, errors.New(respErr.Message))
+		return
+	}
+	shadowLog.StatusCode = http.StatusOK
+	shadowLog.ResponseText = c.GetString(ctxkey.ResponseText)
+	if usage == nil {
+		return
+	}
+	shadowLog.PromptTokens = usage.PromptTokens
+	shadowLog.CompletionTokens = usage.CompletionTokens
+	shadowLog.Quota = calculateQuota(usage, modelConfig)
+
+	err = model.PostConsumeTokenQuota(token.Id, shadowLog.Quota)
+	if err != nil {
+		logger.Error(ctx, "error consuming shadow token quota: "+err.Error())
+	}
+	model.RecordConsumeLog(ctx, &model.Log{
+		UserId:           token.UserId,
+		ChannelId:        channel.Id,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		ModelName:        textRequest.Model,
+		TokenName:        token.Name,
+		Quota:            shadowLog.Quota,
+		Content:          fmt.Sprintf("Shadow #%d of %s", shadow.Id, shadow.Model),
+		ElapsedTime:      shadowLog.ElapsedTime,
+	})
+	model.UpdateUserUsedQuotaAndRequestCount(token.UserId, shadowLog.Quota)
+	model.UpdateChannelUsedQuota(channel.Id, shadowLog.Quota)
+}
@@ -2,10 +2,15 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/eloxt/llmhub/common/config"
+	"github.com/eloxt/llmhub/common/ctxkey"
 	"github.com/eloxt/llmhub/common/logger"
+	"github.com/eloxt/llmhub/middleware"
+	dbmodel "github.com/eloxt/llmhub/model"
 	"github.com/eloxt/llmhub/relay"
 	"github.com/eloxt/llmhub/relay/adaptor"
 	"github.com/eloxt/llmhub/relay/adaptor/openai"
@@ -28,6 +33,9 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 		return openai.ErrorWrapper(c, err, "invalid_text_request", http.StatusBadRequest)
 	}
 	contextMeta.IsStream = textRequest.Stream
+	if contextMeta.ModelAlias != "" {
+		textRequest.Model = c.GetString(ctxkey.OriginalModel)
+	}
 
 	// map model name
 	contextMeta.OriginModelName = textRequest.Model
@@ -35,6 +43,12 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 	contextMeta.ActualModelName = textRequest.Model
 	// set system prompt if not empty
 	systemPromptReset := setSystemPrompt(ctx, textRequest, contextMeta.ForcedSystemPrompt)
+	// apply the parameter policies
+	contextMeta.ParamRules, err = applyParamPolicies(c, textRequest)
+	if err != nil {
+		logger.Warnf(ctx, "request rejected by parameter policy: %s", err.Error())
+		return openai.ErrorWrapper(c, err, "param_rejected", http.StatusBadRequest)
+	}
 	// get model config
 	modelConfig, ok := billing.GetChannelModelConfig(contextMeta.ChannelId, contextMeta.OriginModelName)
 	if !ok {
@@ -43,6 +57,25 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 	// pre-consume quota
 	promptTokens := getPromptTokens(textRequest, contextMeta.Mode)
 	contextMeta.PromptTokens = promptTokens
+	// the unlimited tokens reserve as well, for the budgets
+	preConsumedQuota := getPreConsumedQuota(textRequest, promptTokens, modelConfig)
+	ok, err = dbmodel.ReserveTokenQuota(ctx, contextMeta.TokenId, preConsumedQuota, contextMeta.TokenUnlimited)
+	if errors.Is(err, dbmodel.ErrTokenBudgetExhausted) {
+		return openai.ErrorWrapper(c, err, "token_budget_exhausted", http.StatusForbidden)
+	}
+	if err != nil {
+		return openai.ErrorWrapper(c, err, "pre_consume_token_quota_failed", http.StatusInternalServerError)
+	}
+	if !ok {
+		return openai.ErrorWrapper(c, fmt.Errorf("令牌剩余额度不足，本次请求预计消耗 %.6f", preConsumedQuota), "insufficient_token_quota", http.StatusForbidden)
+	}
+	// the reservation goes back on every error, postConsumeQuota settles it otherwise
+	settled := false
+	defer func() {
+		if !settled {
+			returnPreConsumedQuota(ctx, preConsumedQuota, contextMeta.TokenId)
+		}
+	}()
 
 	adaptorInstance := relay.GetAdaptor(contextMeta.APIType)
 	if adaptorInstance == nil {
@@ -56,8 +89,30 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 		return openai.ErrorWrapper(c, err, "convert_request_failed", http.StatusInternalServerError)
 	}
 
+	shadow := sampleShadow(ctx, contextMeta.OriginModelName)
+	if shadow != nil {
+		c.Set(ctxkey.CaptureResponse, true)
+	}
+
 	// do request
-	resp, err := adaptorInstance.DoRequest(c, contextMeta, requestBody)
+	var resp *http.Response
+	if delay := getHedgeDelay(c, modelConfig); delay > 0 {
+		winner := doHedgedRequest(c, &hedgeAttempt{
+			meta:        contextMeta,
+			adaptor:     adaptorInstance,
+			modelConfig: modelConfig,
+			textRequest: textRequest,
+		}, requestBody, delay)
+		defer winner.cancel()
+		if winner.channel != nil {
+			// the response comes from the hedged channel, bill and log against it
+			middleware.SetupContextForSelectedChannel(c, winner.channel, c.GetString(ctxkey.OriginalModel))
+		}
+		contextMeta, adaptorInstance, modelConfig, textRequest = winner.meta, winner.adaptor, winner.modelConfig, winner.textRequest
+		resp, err = winner.resp, winner.err
+	} else {
+		resp, err = doRequest(c, contextMeta, adaptorInstance, requestBody)
+	}
 	if err != nil {
 		logger.Errorf(ctx, "DoRequest failed: %s", err.Error())
 		return openai.ErrorWrapper(c, err, "do_request_failed", http.StatusInternalServerError)
@@ -73,7 +128,11 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 		return respErr
 	}
 	// post-consume quota
-	go postConsumeQuota(ctx, usage, contextMeta, textRequest, modelConfig, systemPromptReset)
+	settled = true
+	go postConsumeQuota(ctx, usage, contextMeta, textRequest, modelConfig, systemPromptReset, preConsumedQuota)
+	if shadow != nil {
+		go mirrorToShadow(context.WithoutCancel(ctx), shadow, newShadowRequest(c, contextMeta, usage, modelConfig))
+	}
 	return nil
 }
 
@@ -81,7 +140,9 @@ func getRequestBody(c *gin.Context, meta *meta.Meta, textRequest *model.GeneralO
 	if !config.EnforceIncludeUsage &&
 		meta.APIType == apitype.OpenAI &&
 		meta.OriginModelName == meta.ActualModelName &&
-		meta.ForcedSystemPrompt == "" {
+		meta.ModelAlias == "" &&
+		meta.ForcedSystemPrompt == "" &&
+		len(meta.ParamRules) == 0 {
 		// no need to convert request for openai
 		return c.Request.Body, nil
 	}
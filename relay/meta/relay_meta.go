@@ -12,14 +12,19 @@ import (
 )
 
 type Meta struct {
-	Mode         int
-	ChannelType  int
-	ChannelId    int
-	TokenId      int
-	TokenName    string
-	UserId       int
-	Group        string
-	ModelMapping map[string]string
+	Mode        int
+	ChannelType int
+	ChannelId   int
+	TokenId     int
+	TokenName   string
+	TokenTPM    int
+	// TokenUnlimited is set when the token has unlimited quota, nothing is reserved for it then
+	TokenUnlimited bool
+	// KeyGeneration is the generation of the token key used by the request
+	KeyGeneration int
+	UserId        int
+	Group         string
+	ModelMapping  map[string]string
 	// BaseURL is the proxy url set in the channel config
 	BaseURL  string
 	APIKey   string
@@ -29,11 +34,20 @@ type Meta struct {
 	// OriginModelName is the model name from the raw user request
 	OriginModelName string
 	// ActualModelName is the model name after mapping
-	ActualModelName    string
+	ActualModelName string
+	// ModelAlias is the alias requested by the user, OriginModelName is then the model it resolved to
+	ModelAlias         string
 	RequestURLPath     string
 	PromptTokens       int // only for DoResponse
 	ForcedSystemPrompt string
 	StartTime          time.Time
+	// Hedged is set when the request has been sent to a second channel, HedgeWon when that one answered first
+	Hedged   bool
+	HedgeWon bool
+	// ParamRules are the parameter policy rules which changed the request
+	ParamRules []string
+	// Tags are the cost attribution tags of the request
+	Tags map[string]string
 }
 
 func GetByContext(c *gin.Context) *Meta {
@@ -43,6 +57,9 @@ func GetByContext(c *gin.Context) *Meta {
 		ChannelId:          c.GetInt(ctxkey.ChannelId),
 		TokenId:            c.GetInt(ctxkey.TokenId),
 		TokenName:          c.GetString(ctxkey.TokenName),
+		TokenTPM:           c.GetInt(ctxkey.TokenTPM),
+		TokenUnlimited:     c.GetBool(ctxkey.TokenUnlimited),
+		KeyGeneration:      c.GetInt(ctxkey.KeyGeneration),
 		UserId:             c.GetInt(ctxkey.Id),
 		Group:              c.GetString(ctxkey.Group),
 		ModelMapping:       c.GetStringMapString(ctxkey.ModelMapping),
@@ -51,8 +68,12 @@ func GetByContext(c *gin.Context) *Meta {
 		APIKey:             strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer "),
 		RequestURLPath:     c.Request.URL.String(),
 		ForcedSystemPrompt: c.GetString(ctxkey.SystemPrompt),
+		ModelAlias:         c.GetString(ctxkey.ModelAlias),
 		StartTime:          time.Now(),
 	}
+	if tags, ok := c.Get(ctxkey.Tags); ok {
+		meta.Tags, _ = tags.(map[string]string)
+	}
 	cfg, ok := c.Get(ctxkey.Config)
 	if ok {
 		meta.Config = cfg.(model.ChannelConfig)
@@ -9,6 +9,10 @@ type Usage struct {
 	PromptCacheHitTokens  int `json:"prompt_cache_hit_tokens"`
 	PromptCacheMissTokens int `json:"prompt_cache_miss_tokens"`
 
+	// Anthropic
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+
 	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
 	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details,omitempty"`
 }
@@ -20,7 +24,48 @@ type CompletionTokensDetails struct {
 }
 
 type PromptTokensDetails struct {
-	CachedTokens int `json:"cached_tokens"`
+	CachedTokens     int `json:"cached_tokens"`
+	CacheWriteTokens int `json:"cache_write_tokens,omitempty"`
+}
+
+// UsageBreakdown splits the usage into the buckets which are billed at different prices
+type UsageBreakdown struct {
+	UncachedTokens   int
+	CacheReadTokens  int
+	CacheWriteTokens int
+	CompletionTokens int // including the reasoning tokens
+	ReasoningTokens  int
+}
+
+func (b UsageBreakdown) PromptTokens() int {
+	return b.UncachedTokens + b.CacheReadTokens + b.CacheWriteTokens
+}
+
+// Breakdown normalizes the cache usage reported as OpenAI prompt_tokens_details, DeepSeek
+// prompt_cache_hit_tokens or Anthropic cache_creation/read_input_tokens.
+// The prompt tokens include the cached ones, except with Anthropic which reports them apart.
+func (u *Usage) Breakdown() UsageBreakdown {
+	var b UsageBreakdown
+	switch {
+	case u.CacheReadInputTokens > 0 || u.CacheCreationInputTokens > 0:
+		b.CacheReadTokens = max(u.CacheReadInputTokens, 0)
+		b.CacheWriteTokens = max(u.CacheCreationInputTokens, 0)
+		b.UncachedTokens = max(u.PromptTokens, 0)
+	case u.PromptTokensDetails != nil && (u.PromptTokensDetails.CachedTokens > 0 || u.PromptTokensDetails.CacheWriteTokens > 0):
+		b.CacheReadTokens = max(u.PromptTokensDetails.CachedTokens, 0)
+		b.CacheWriteTokens = max(u.PromptTokensDetails.CacheWriteTokens, 0)
+		b.UncachedTokens = max(u.PromptTokens-b.CacheReadTokens-b.CacheWriteTokens, 0)
+	case u.PromptCacheHitTokens > 0:
+		b.CacheReadTokens = u.PromptCacheHitTokens
+		b.UncachedTokens = max(u.PromptTokens-b.CacheReadTokens, 0)
+	default:
+		b.UncachedTokens = max(u.PromptTokens, 0)
+	}
+	b.CompletionTokens = max(u.CompletionTokens, 0)
+	if u.CompletionTokensDetails != nil {
+		b.ReasoningTokens = min(max(u.CompletionTokensDetails.ReasoningTokens, 0), b.CompletionTokens)
+	}
+	return b
 }
 
 type Error struct {
@@ -0,0 +1,73 @@
+package model
+
+import "testing"
+
+func TestUsageBreakdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage Usage
+		want  UsageBreakdown
+	}{
+		{
+			name:  "no cache",
+			usage: Usage{PromptTokens: 100, CompletionTokens: 20},
+			want:  UsageBreakdown{UncachedTokens: 100, CompletionTokens: 20},
+		},
+		{
+			name: "openai cached tokens are part of the prompt",
+			usage: Usage{PromptTokens: 100, CompletionTokens: 20,
+				PromptTokensDetails: &PromptTokensDetails{CachedTokens: 60}},
+			want: UsageBreakdown{UncachedTokens: 40, CacheReadTokens: 60, CompletionTokens: 20},
+		},
+		{
+			name: "openai cache writes",
+			usage: Usage{PromptTokens: 100,
+				PromptTokensDetails: &PromptTokensDetails{CachedTokens: 30, CacheWriteTokens: 50}},
+			want: UsageBreakdown{UncachedTokens: 20, CacheReadTokens: 30, CacheWriteTokens: 50},
+		},
+		{
+			name:  "openai empty details",
+			usage: Usage{PromptTokens: 100, PromptTokensDetails: &PromptTokensDetails{}},
+			want:  UsageBreakdown{UncachedTokens: 100},
+		},
+		{
+			name:  "deepseek cache hits are part of the prompt",
+			usage: Usage{PromptTokens: 100, PromptCacheHitTokens: 80, PromptCacheMissTokens: 20},
+			want:  UsageBreakdown{UncachedTokens: 20, CacheReadTokens: 80},
+		},
+		{
+			name:  "anthropic cache tokens are apart from the prompt",
+			usage: Usage{PromptTokens: 10, CompletionTokens: 5, CacheReadInputTokens: 1000, CacheCreationInputTokens: 200},
+			want:  UsageBreakdown{UncachedTokens: 10, CacheReadTokens: 1000, CacheWriteTokens: 200, CompletionTokens: 5},
+		},
+		{
+			name:  "cached tokens above the prompt",
+			usage: Usage{PromptTokens: 10, PromptTokensDetails: &PromptTokensDetails{CachedTokens: 30}},
+			want:  UsageBreakdown{UncachedTokens: 0, CacheReadTokens: 30},
+		},
+		{
+			name: "reasoning tokens are part of the completion",
+			usage: Usage{PromptTokens: 10, CompletionTokens: 50,
+				CompletionTokensDetails: &CompletionTokensDetails{ReasoningTokens: 40}},
+			want: UsageBreakdown{UncachedTokens: 10, CompletionTokens: 50, ReasoningTokens: 40},
+		},
+		{
+			name: "reasoning tokens above the completion",
+			usage: Usage{CompletionTokens: 10,
+				CompletionTokensDetails: &CompletionTokensDetails{ReasoningTokens: 40}},
+			want: UsageBreakdown{CompletionTokens: 10, ReasoningTokens: 10},
+		},
+		{
+			name:  "negative counts",
+			usage: Usage{PromptTokens: -1, CompletionTokens: -1},
+			want:  UsageBreakdown{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.usage.Breakdown(); got != tt.want {
+				t.Errorf("Breakdown() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
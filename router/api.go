@@ -19,6 +19,7 @@ func SetApiRouter(router *gin.Engine) {
 		{
 			userRoute.POST("/login", middleware.CriticalRateLimit(), controller.Login)
 			userRoute.GET("/logout", controller.Logout)
+			userRoute.PUT("/group", middleware.UserAuth(), controller.UpdateUserGroup)
 		}
 		channelRoute := apiRouter.Group("/channel")
 		channelRoute.Use(middleware.UserAuth())
@@ -43,18 +44,61 @@ func SetApiRouter(router *gin.Engine) {
 		{
 			tokenRoute.GET("/", controller.GetAllTokens)
 			tokenRoute.GET("", controller.GetAllTokens)
+			tokenRoute.GET("/budgets", controller.GetTokenBudgets)
 			tokenRoute.GET("/:id", controller.GetToken)
 			tokenRoute.POST("/", controller.AddToken)
 			tokenRoute.POST("", controller.AddToken)
 			tokenRoute.PUT("/", controller.UpdateToken)
 			tokenRoute.PUT("", controller.UpdateToken)
 			tokenRoute.DELETE("/:id", controller.DeleteToken)
+			tokenRoute.POST("/:id/rotate", controller.RotateTokenKey)
+		}
+		childTokenRoute := apiRouter.Group("/token/children")
+		childTokenRoute.Use(middleware.TokenAuth())
+		{
+			childTokenRoute.GET("", controller.GetChildTokens)
+			childTokenRoute.POST("", controller.AddChildToken)
+			childTokenRoute.DELETE("/:id", controller.RevokeChildToken)
+		}
+		aliasRoute := apiRouter.Group("/alias")
+		aliasRoute.Use(middleware.UserAuth())
+		{
+			aliasRoute.GET("/", controller.GetAllAliases)
+			aliasRoute.GET("", controller.GetAllAliases)
+			aliasRoute.GET("/:id", controller.GetAlias)
+			aliasRoute.POST("/", controller.AddAlias)
+			aliasRoute.POST("", controller.AddAlias)
+			aliasRoute.PUT("/", controller.UpdateAlias)
+			aliasRoute.PUT("", controller.UpdateAlias)
+			aliasRoute.DELETE("/:id", controller.DeleteAlias)
+		}
+		shadowRoute := apiRouter.Group("/shadow")
+		shadowRoute.Use(middleware.UserAuth())
+		{
+			shadowRoute.GET("/", controller.GetAllShadows)
+			shadowRoute.GET("", controller.GetAllShadows)
+			shadowRoute.GET("/:id", controller.GetShadow)
+			shadowRoute.GET("/:id/logs", controller.GetShadowLogs)
+			shadowRoute.POST("/", controller.AddShadow)
+			shadowRoute.POST("", controller.AddShadow)
+			shadowRoute.PUT("/", controller.UpdateShadow)
+			shadowRoute.PUT("", controller.UpdateShadow)
+			shadowRoute.DELETE("/:id", controller.DeleteShadow)
+		}
+		priceRoute := apiRouter.Group("/price")
+		priceRoute.Use(middleware.UserAuth())
+		{
+			priceRoute.GET("/changes", controller.GetPriceChanges)
+			priceRoute.POST("/changes/:id/approve", controller.ApprovePriceChange)
+			priceRoute.POST("/changes/:id/reject", controller.RejectPriceChange)
+			priceRoute.POST("/sync", controller.SyncPrices)
 		}
 		logRoute := apiRouter.Group("/log")
 		logRoute.Use(middleware.UserAuth())
 		{
 			logRoute.GET("/", controller.GetAllLogs)
 			logRoute.GET("", controller.GetAllLogs)
+			logRoute.GET("/export", controller.ExportLogs)
 			logRoute.DELETE("/", controller.DeleteHistoryLogs)
 			logRoute.DELETE("", controller.DeleteHistoryLogs)
 		}